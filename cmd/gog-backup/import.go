@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/mscharley/gog-backup/internal/gog-backup/state"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/gog"
+	"github.com/vbauerster/mpb/v5"
+)
+
+// importFile adds a file which were backed up before the index existed to the index, based on the version files stored
+// alongside them.
+func importFile(ctx context.Context, p *mpb.Progress, handler backend.Handler, client *gog.Client, db *state.State, d *backend.GogFile, basepath string) {
+	filename, _, err := client.StatFile(ctx, d.URL)
+	if err != nil {
+		writeLog(p, fmt.Sprintf("Unable to fetch file details from GoG for %s (%s): %+v", d.PlainName, d.URL, err))
+	} else {
+		file := path.Join(basepath, filename)
+		location := state.Location(handler, file)
+		if db.Lookup(location) == nil {
+			if info, err := handler.Stat(ctx, file); err == nil {
+				lastVersion, _ := handler.ReadFile(ctx, path.Join(basepath, "."+filename+".version"))
+				err = db.Record(&state.Entry{
+					ProductID: d.ProductID,
+					File:      file,
+					Version:   lastVersion,
+					Size:      info.Size,
+					Location:  location,
+					Source:    d.URL,
+				})
+				if err != nil {
+					writeLog(p, fmt.Sprintf("Unable to save the index: %+v", err))
+				}
+			}
+		}
+	}
+}
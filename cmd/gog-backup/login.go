@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+// loginCode extracts the authorisation code from whatever the user pasted, which may either be the address of the page
+// GoG redirected them to or just the code itself.
+func loginCode(input string) string {
+	input = strings.TrimSpace(input)
+	if parsed, err := url.Parse(input); err == nil && parsed.Query().Get("code") != "" {
+		return parsed.Query().Get("code")
+	}
+	return input
+}
+
+func login(ctx context.Context, client *gog.Client, in io.Reader, out io.Writer) error {
+	if client.TokenStore == nil {
+		return fmt.Errorf("Logging in requires somewhere to save tokens, please provide -token-file")
+	}
+
+	fmt.Fprintf(out, "Open this address in your browser and log in to GoG.com:\n\n  %s\n\n", client.LoginURL())
+	fmt.Fprintf(out, "Once you have logged in you will end up on a mostly blank page. Copy the address of that page and paste it here: ")
+	input, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !(err == io.EOF && input != "") {
+		return err
+	}
+
+	code := loginCode(input)
+	if code == "" {
+		return fmt.Errorf("No login code provided")
+	}
+	err = client.Login(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Logged in successfully, your tokens have been saved to %s\n", *tokenFile)
+	return nil
+}
+
+func loginCommand(ctx context.Context, client *gog.Client) {
+	if err := login(ctx, client, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to log in: %+v\n", err)
+		os.Exit(1)
+	}
+}
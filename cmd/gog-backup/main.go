@@ -1,24 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/bclicn/color"
 	"github.com/juju/ratelimit"
-	"github.com/mscharley/gog-backup/internal/gog-backup/backend"
-	"github.com/mscharley/gog-backup/internal/gog-backup/backend/local"
-	"github.com/mscharley/gog-backup/internal/gog-backup/backend/s3"
+	"github.com/mscharley/gog-backup/internal/gog-backup/filter"
+	"github.com/mscharley/gog-backup/internal/gog-backup/metrics"
+	"github.com/mscharley/gog-backup/internal/gog-backup/notify"
+	"github.com/mscharley/gog-backup/internal/gog-backup/report"
+	"github.com/mscharley/gog-backup/internal/gog-backup/state"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backend/crypt"
+	"github.com/mscharley/gog-backup/pkg/backend/local"
+	"github.com/mscharley/gog-backup/pkg/backend/mirror"
+	"github.com/mscharley/gog-backup/pkg/backend/s3"
+	"github.com/mscharley/gog-backup/pkg/backend/sftp"
+	"github.com/mscharley/gog-backup/pkg/backup"
 	"github.com/mscharley/gog-backup/pkg/gog"
 	"github.com/vbauerster/mpb/v5"
 	"github.com/vbauerster/mpb/v5/decor"
@@ -27,25 +36,52 @@ import (
 )
 
 var (
-	waitGroup = new(sync.WaitGroup)
-)
-
-var (
-	backendOpt     = flag.String("backend", "local", "Which backend to use for processing files to backup. The default, local, uses a folder on your hard drive.")
+	backendOpt     = flag.String("backend", "local", "Which backend to use for processing files to backup. The default, local, uses a folder on your hard drive. Multiple backends may be given separated by commas to back up to all of them at once.")
+	encrypt        = flag.Bool("encrypt", false, "Encrypt files before they are stored in the backend. See -encrypt-key-file and -encrypt-passphrase.")
 	refreshToken   = flag.String("refresh-token", "", "A refresh token for the GoG API.")
-	retries        = flag.Int("retries", 3, "How many times to retry downloading a file before giving up.")
+	tokenFile      = flag.String("token-file", os.Getenv("HOME")+"/.gog-backup-token.json", "Where to save the latest tokens for the GoG API between runs. Tokens in this file take precedence over -refresh-token, remove it to start over with a new refresh token. Set to an empty string to disable.")
+	retries        = flag.Int("retries", 3, "How many times to retry downloading a file, or fetching your library from GoG, before giving up.")
+	retryDelay     = flag.Duration("retry-delay", 5*time.Second, "How long to wait before retrying a failed download. The wait doubles after every attempt up to -retry-max-delay, with some randomness added.")
+	retryMaxDelay  = flag.Duration("retry-max-delay", 5*time.Minute, "The longest to wait between attempts at a failed download, unless GoG asks us to wait longer.")
 	cleanupTimeout = flag.Int64("cleanup-timeout", 300, "How long in seconds to allow current downloads to finish.")
+	reportFile     = flag.String("report", "", "Write a JSON report of the run to this file at the end of the run, or - for stdout in which case everything else is written to stderr.")
+	metricsListen  = flag.String("metrics-listen", "", "Serve Prometheus metrics from /metrics on this address, eg. :9100. (default: disabled)")
 
 	debug    = flag.Bool("debug", false, "Display debug messages.")
 	dryRun   = flag.Bool("dry-run", false, "Do a dry run without actually backing up files.")
 	progress = flag.Bool("progress", true, "Display progress bars.")
+	movies   = flag.Bool("movies", true, "Back up movies as well as games. Movies are stored in a separate Movies folder.")
+
+	checksums = flag.Bool("checksums", true, "Verify downloads against the MD5 checksums published by GoG where available.")
 
 	gameDownloads  = flag.Int("game-downloads", 2, "How many game downloads to do concurrently.")
 	extraDownloads = flag.Int("extra-downloads", 2, "How many extras to download concurrently.")
 	limitDownload  = flag.Int("limit-download", 0, "Download limit in KiB/s. (default: unlimited)")
 	limitUpload    = flag.Int("limit-upload", 0, "Upload limit in KiB/s (default: unlimited)")
+
+	keepVersions    = flag.Int("keep-versions", 0, "How many previous versions of each file to keep when GoG releases an update. Previous versions are moved to a .archive folder alongside the file. (default: don't keep previous versions)")
+	keepVersionsAge = flag.Duration("keep-versions-age", 0, "Keep previous versions of each file for this long after they're replaced, eg. 2160h for 90 days. May be combined with -keep-versions. (default: don't keep previous versions)")
+)
+
+// These are the exit codes used to describe the outcome of a run.
+const (
+	exitPartialFailure = 2
+	exitAuthFailure    = 3
+	exitBackendFailure = 4
 )
 
+// output is where everything meant for the user is written. It's stderr rather than stdout when the report is being
+// written to stdout, so that the report can still be parsed.
+var output = os.Stdout
+
+// consoleOutput picks where everything meant for the user should be written.
+func consoleOutput() *os.File {
+	if *reportFile == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
 type nullWriter struct{}
 
 func (n *nullWriter) Write(p []byte) (int, error) {
@@ -54,7 +90,7 @@ func (n *nullWriter) Write(p []byte) (int, error) {
 
 func writeLog(progress *mpb.Progress, msg string) {
 	if progress == nil {
-		fmt.Printf("%s\n", msg)
+		fmt.Fprintf(output, "%s\n", msg)
 	} else {
 		progress.Add(0, mpb.BarFillerFunc(func(w io.Writer, _ int, st decor.Statistics) {
 			fmt.Fprintf(w, fmt.Sprintf("%%.%ds", st.AvailableWidth-2), msg)
@@ -64,7 +100,22 @@ func writeLog(progress *mpb.Progress, msg string) {
 
 func main() {
 	iniflags.Parse()
-	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
+	rand.Seed(time.Now().UnixNano())
+	command := "backup"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	switch command {
+	case "backup", "verify", "login", "import-state", "restore", "migrate", "prune", "serve":
+	case "decrypt":
+		decryptCommand()
+		return
+	default:
+		log.Fatalf("Unknown command (%s): valid values are; backup, verify, login, import-state, restore, migrate, prune, serve, decrypt", command)
+	}
+
+	output = consoleOutput()
+	if !terminal.IsTerminal(int(output.Fd())) {
 		*progress = false
 	}
 	if !*debug {
@@ -79,354 +130,335 @@ func main() {
 		*progress = false
 	}
 
-	if *refreshToken == "" {
-		log.Fatalln("You must provide a refresh token for GoG.com via -refresh-token.")
-	}
-
 	client := &gog.Client{
 		Client:       http.DefaultClient,
 		RefreshToken: *refreshToken,
 	}
+	if *tokenFile != "" {
+		client.TokenStore = &gog.FileTokenStore{Path: *tokenFile}
+	}
+
+	// Cancelling finished stops new work from being started, cancelling ctx aborts anything already in progress.
+	ctx, abort := context.WithCancel(context.Background())
+	defer abort()
+	finished, stop := context.WithCancel(ctx)
+
+	if command == "login" {
+		loginCommand(ctx, client)
+		return
+	}
+
+	if *refreshToken == "" && command != "restore" && command != "migrate" {
+		var token *gog.Token
+		if client.TokenStore != nil {
+			token, _ = client.TokenStore.LoadToken()
+		}
+		if token == nil || token.RefreshToken == "" {
+			log.Fatalln("You must provide a refresh token for GoG.com via -refresh-token or by running `gog-backup login`.")
+		}
+	}
 
 	var err error
 	var backendHandler backend.Handler
 	var downloadBucket *ratelimit.Bucket
 	var uploadBucket *ratelimit.Bucket
-	var progressBar *mpb.Progress
-	var gameBar *mpb.Bar
-	var filesBar *mpb.Bar
 
 	if *limitDownload > 0 {
 		downloadBucket = ratelimit.NewBucketWithRate(float64(*limitDownload*1024), int64(*limitDownload*1024))
+		metrics.RateLimit.WithLabelValues("download").Set(downloadBucket.Rate())
 	}
 	if *limitUpload > 0 {
 		uploadBucket = ratelimit.NewBucketWithRate(float64(*limitUpload*1024), int64(*limitUpload*1024))
+		metrics.RateLimit.WithLabelValues("upload").Set(uploadBucket.Rate())
 	}
 
-	switch *backendOpt {
-	case "local":
-		backendHandler = local.NewHandler()
-	case "s3":
-		backendHandler, err = s3.NewHandler(uploadBucket)
-	default:
-		log.Fatalf("Unknown backend (%s): valid values are; local, s3", *backendOpt)
+	backendHandler, err = newBackend(*backendOpt, uploadBucket)
+	if err == nil && *encrypt {
+		backendHandler, err = crypt.NewHandler(backendHandler)
 	}
-
 	if err != nil {
-		log.Fatalf("Error loading the backend (%s): %+v", *backendOpt, err)
-	}
-
-	finished := make(chan bool, 1)
-	gameInfo := make(chan int64)
-	gameDownload := make(chan *backend.GogFile, 500)
-	extraDownload := make(chan *backend.GogFile, 500)
-	if *progress {
-		progressBar = mpb.New(
-			mpb.PopCompletedMode(),
-			mpb.WithRefreshRate(250*time.Millisecond),
-		)
-	}
-	if progressBar != nil {
-		gameBar = progressBar.AddBar(1, mpb.BarStyle("[=>-]"),
-			mpb.BarNoPop(),
-			mpb.PrependDecorators(
-				decor.Name("Games processed "),
-				decor.CountersNoUnit("[%d / %d]"),
-			),
-		)
-	}
-	if progressBar != nil {
-		filesBar = progressBar.AddBar(1, mpb.BarStyle("[=>-]"),
-			mpb.BarNoPop(),
-			mpb.PrependDecorators(
-				decor.Name("Files processed "),
-				decor.CountersNoUnit("[%d / %d]"),
-			),
-		)
-	}
-
-	go signalHandler(finished)
-	go generateGames(gameInfo, finished, gameBar, client)
-	go fetchDetails(gameInfo, gameDownload, extraDownload, filesBar, client)
-
-	waitGroup.Add(*gameDownloads + *extraDownloads)
-	for i := 0; i < *gameDownloads; i++ {
-		go downloadFiles(retries, downloadBucket, progressBar, filesBar, backendHandler, gameDownload, waitGroup, client)
-	}
-	for i := 0; i < *extraDownloads; i++ {
-		go downloadFiles(retries, downloadBucket, progressBar, filesBar, backendHandler, extraDownload, waitGroup, client)
-	}
-
-	log.Printf("Waiting for threads to complete.")
-	waitGroup.Wait()
-	if progressBar != nil {
-		gameBar.SetTotal(0, true)
-		filesBar.SetTotal(0, true)
-		progressBar.Wait()
+		fmt.Fprintf(os.Stderr, "Error loading the backend (%s): %+v\n", *backendOpt, err)
+		os.Exit(exitBackendFailure)
 	}
-	log.Printf("Closing main().")
-}
 
-func generateGames(games chan<- int64, finished <-chan bool, bar *mpb.Bar, client *gog.Client) {
-	page := 0
-	totalPages := 1
-	defer close(games)
-	for page < totalPages {
-		page++
-		if page == 1 {
-			log.Printf("Fetching page %d", page)
-		} else {
-			log.Printf("Fetching page %d/%d", page, totalPages)
-		}
-		result, err := client.GetFilteredProducts(gog.GameMediaType, page)
-		if err != nil {
-			log.Printf("error: %+v", err)
-			return
-		}
-
-		if bar != nil {
-			bar.SetTotal(int64(result.TotalProducts), false)
-		}
-		totalPages = result.TotalPages
-		for _, product := range result.Products {
-			select {
-			case games <- product.ID:
-				if bar != nil {
-					bar.Increment()
-				}
-			case _ = <-finished:
-				if bar != nil {
-					bar.SetTotal(int64(result.TotalProducts), true)
-				}
-				return
-			}
-		}
+	if lock, err := acquireLock(command); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	} else if lock != nil {
+		defer lock.Release()
 	}
-}
 
-func safePath(path string) string {
-	return strings.Replace(
-		strings.Replace(strings.TrimSpace(path), "/", "", -1),
-		":", " -", -1)
-}
+	if notifier, err = notify.New(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading notifications: %+v\n", err)
+		os.Exit(1)
+	}
+	defer notifier.Close()
 
-func fetchDetails(games <-chan int64, gameDownload chan<- *backend.GogFile, extraDownload chan<- *backend.GogFile, bar *mpb.Bar, client *gog.Client) {
-	totalFiles := 0
-	for id := range games {
-		log.Printf("Fetching details for %d", id)
-		result, err := client.GameDetails(id)
-		if err != nil {
-			log.Printf("Unable for fetch details for %d: %+v", id, err)
-		} else {
-			var games []struct {
-				Path    string
-				Details *gog.GameDetails
+	if *metricsListen != "" {
+		if err = metrics.Serve(*metricsListen); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to serve metrics on %s: %+v\n", *metricsListen, err)
+			os.Exit(1)
+		}
+		client.OnRequest = func(endpoint string, duration time.Duration, err error) {
+			metrics.APIRequests.WithLabelValues(endpoint).Observe(duration.Seconds())
+			if err != nil {
+				metrics.APIErrors.WithLabelValues(endpoint).Inc()
 			}
-			games = append(games, struct {
-				Path    string
-				Details *gog.GameDetails
-			}{safePath(result.Title), result})
-			for i := 0; i < len(games); i++ {
-				basepath := games[i].Path
-				game := games[i].Details
-				totalFiles += len(game.Extras)
-				if bar != nil {
-					bar.SetTotal(int64(totalFiles), false)
-				}
-
-				for _, extra := range game.Extras {
-					extraDownload <- &backend.GogFile{
-						Name:      fmt.Sprintf("%s %s", color.LightPurple("Extra for "+game.Title+": "+extra.Name), color.LightYellow("["+extra.Size+"]")),
-						PlainName: "Extra for " + game.Title + ": " + extra.Name,
-						URL:       gog.EmbedEndpoint + extra.ManualDownloadURL,
-						File:      path.Join(basepath, "Extras"),
-						Version:   extra.Version,
-					}
-				}
-
-				if len(game.Downloads) > 0 {
-					download := game.Downloads[0]
-					totalFiles += len(download.Platforms.Windows) + len(download.Platforms.Mac) + len(download.Platforms.Linux)
-					if bar != nil {
-						bar.SetTotal(int64(totalFiles), false)
-					}
-					for _, d := range download.Platforms.Windows {
-						gameDownload <- &backend.GogFile{
-							Name:      fmt.Sprintf("%s %s %s", color.LightPurple(d.Name), color.Red("[Windows]"), color.LightYellow("["+d.Size+"]")),
-							PlainName: d.Name,
-							Platform:  "Windows",
-							URL:       gog.EmbedEndpoint + d.ManualDownloadURL,
-							File:      path.Join(basepath, "Windows"),
-							Version:   d.Version,
-						}
-					}
-					for _, d := range download.Platforms.Mac {
-						gameDownload <- &backend.GogFile{
-							Name:      fmt.Sprintf("%s %s %s", color.LightPurple(d.Name), color.Red("[Mac]"), color.LightYellow("["+d.Size+"]")),
-							PlainName: d.Name,
-							Platform:  "Mac",
-							URL:       gog.EmbedEndpoint + d.ManualDownloadURL,
-							File:      path.Join(basepath, "Mac"),
-							Version:   d.Version,
-						}
-					}
-					for _, d := range download.Platforms.Linux {
-						gameDownload <- &backend.GogFile{
-							Name:      fmt.Sprintf("%s %s %s", color.LightPurple(d.Name), color.Red("[Linux]"), color.LightYellow("["+d.Size+"]")),
-							PlainName: d.Name,
-							Platform:  "Linux",
-							URL:       gog.EmbedEndpoint + d.ManualDownloadURL,
-							File:      path.Join(basepath, "Linux"),
-							Version:   d.Version,
-						}
-					}
-				}
-
-				for _, dlc := range game.DLCs {
-					games = append(games, struct {
-						Path    string
-						Details *gog.GameDetails
-					}{path.Join(basepath, safePath(dlc.Title)), dlc})
-				}
+			if endpoint == "token" {
+				metrics.TokenRefreshes.Inc()
 			}
 		}
 	}
-	log.Printf("Fetched details for all files")
-
-	close(gameDownload)
-	close(extraDownload)
-}
 
-func signalHandler(finished chan<- bool) {
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go signalHandler(stop, abort)
+	if command == "restore" {
+		restoreCommand(ctx, backendHandler)
+		return
+	} else if command == "migrate" {
+		migrateCommand(ctx, finished, backendHandler, uploadBucket)
+		return
+	} else if command == "serve" {
+		serve(ctx, finished, client, backendHandler, downloadBucket)
+		return
+	}
 
-	signal := <-c
-	finished <- true
-	close(finished)
-	log.Printf("Received a %s signal, finishing downloads before closing.", signal)
-	timeout := time.After(time.Second * time.Duration(*cleanupTimeout))
-	select {
-	case signal = <-c:
-		log.Fatalf("Received a second %s signal, closing down without cleanup.", signal)
-	case _ = <-timeout:
-		log.Fatalf("Closing after waiting %d seconds.", *cleanupTimeout)
+	runReport := run(ctx, finished, command, client, backendHandler, downloadBucket)
+	notifier.Close()
+	if command == "verify" && !reportVerification() {
+		os.Exit(1)
+	}
+	if code := exitCode(runReport); code != 0 {
+		log.Printf("Closing main() with exit code %d.", code)
+		os.Exit(code)
 	}
+	log.Printf("Closing main().")
 }
 
-func downloadFiles(retries *int, downloadBucket *ratelimit.Bucket, p *mpb.Progress, filesBar *mpb.Bar, handler backend.Handler, downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
-	prefix := handler.GetPrefix()
-	displayPrefix := handler.GetDisplayPrefix()
+// run processes the whole library once for a command. Once finished is cancelled no more games are fetched, and once
+// ctx is cancelled anything still in progress is abandoned.
+func run(ctx context.Context, finished context.Context, command string, client *gog.Client, backendHandler backend.Handler, downloadBucket *ratelimit.Bucket) *report.Report {
+	filters, err := filter.New()
+	if err != nil {
+		log.Fatalf("Error loading filters: %+v", err)
+	}
+
+	db, err := state.Open()
+	if err != nil {
+		log.Fatalf("Error loading the index: %+v", err)
+	}
 
-	loop := func(d *backend.GogFile, attempt int, basepath string) bool {
-		filename, readerTmp, contentLength, err := client.DownloadFile(d.URL)
+	if command == "backup" {
+		startNotifications(db)
+	}
+	display := newDisplay()
+	engine, err := backup.New(backup.Options{
+		Client:          client,
+		Handler:         backendHandler,
+		Filter:          filters,
+		Index:           db,
+		Metrics:         metrics.Engine{},
+		Movies:          *movies,
+		GameDownloads:   *gameDownloads,
+		ExtraDownloads:  *extraDownloads,
+		Retries:         *retries,
+		RetryDelay:      *retryDelay,
+		RetryMaxDelay:   *retryMaxDelay,
+		Checksums:       *checksums,
+		DryRun:          *dryRun,
+		DownloadBucket:  downloadBucket,
+		KeepVersions:    *keepVersions,
+		KeepVersionsAge: *keepVersionsAge,
+		OnLog:           display.log,
+		OnProgress:      display.update,
+		OnResult: func(result *backup.Result) {
+			if command == "prune" && result.Type == backup.Filtered {
+				pruneFiltered(result.Path)
+			}
+			recordResult(result)
+			showResult(ctx, result)
+		},
+	})
+	if err != nil {
+		log.Fatalf("Error starting the backup: %+v", err)
+	}
 
-		var platform string
-		if d.Platform != "" {
-			platform = " " + "[" + d.Platform + "]"
-		}
+	var runReport *report.Report
+	switch command {
+	case "verify":
+		runReport = engine.Each(ctx, finished, func(ctx context.Context, d *backend.GogFile, basepath string) {
+			verifyFile(ctx, display.progress, backendHandler, client, db, d, basepath)
+		})
+	case "import-state":
+		runReport = engine.Each(ctx, finished, func(ctx context.Context, d *backend.GogFile, basepath string) {
+			importFile(ctx, display.progress, backendHandler, client, db, d, basepath)
+		})
+	case "prune":
+		runReport = engine.Each(ctx, finished, func(ctx context.Context, d *backend.GogFile, basepath string) {
+			pruneFile(ctx, display.progress, client, d, basepath)
+		})
+	default:
+		runReport = engine.Backup(ctx, finished)
+	}
+	display.wait()
 
-		if err != nil {
-			writeLog(p, fmt.Sprintf("[%d] Unable to connect to GoG for %s%s (%s): %#v\n", attempt, d.PlainName, platform, d.URL, err))
-			return false
-		}
-		if contentLength == nil {
-			log.Fatalf("No Content-Length available for %s", d.URL)
+	if command == "prune" {
+		pruneOrphans(ctx, backendHandler, db, runReport)
+	}
+	if err = db.Save(); err != nil {
+		log.Printf("Unable to save the index: %+v", err)
+	}
+	if *reportFile != "" {
+		if err = writeReport(runReport, *reportFile); err != nil {
+			log.Printf("Unable to write report: %+v", err)
 		}
+	}
 
-		var reader io.Reader = readerTmp
-		if downloadBucket != nil {
-			reader = ratelimit.Reader(reader, downloadBucket)
-		}
+	metrics.LastRun.SetToCurrentTime()
+	if command == "backup" && exitCode(runReport) == 0 {
+		metrics.LastSuccess.SetToCurrentTime()
+	}
+	if command == "backup" {
+		notifyFinished(runReport)
+	}
+	return runReport
+}
 
-		// Check for version information from last time.
-		versionFile := path.Join(basepath, "."+filename+".version")
-		if d.Version != "" {
-			if lastVersion, _ := handler.ReadFile(versionFile); string(lastVersion) == d.Version {
-				log.Printf("Skipping %s%s as it is already up to date.\n", d.PlainName, platform)
-				readerTmp.Close()
-				return true
-			}
-		} else if info, _ := handler.FileExists(path.Join(basepath, filename)); info {
-			log.Printf("Skipping %s%s as it is already backed up and isn't versioned.\n", d.PlainName, platform)
-			readerTmp.Close()
-			return true
-		}
+// recordResult keeps the file metrics up to date.
+func recordResult(result *backup.Result) {
+	switch result.Type {
+	case backup.Downloaded:
+		metrics.Files.WithLabelValues("downloaded").Inc()
+	case backup.Skipped:
+		metrics.Files.WithLabelValues("skipped").Inc()
+	case backup.Failed:
+		metrics.Files.WithLabelValues("failed").Inc()
+	}
+}
 
-		if p != nil {
-			bar := p.AddBar(*contentLength, mpb.BarStyle("[=>-|"),
-				mpb.BarNoPop(),
-				mpb.BarRemoveOnComplete(),
-				mpb.PrependDecorators(
-					decor.Name(fmt.Sprintf("[A%d] %s%s", attempt, d.PlainName, platform)),
-					decor.CountersKibiByte(" [% .2f / % .2f]"),
-				),
-				mpb.AppendDecorators(
-					decor.EwmaETA(decor.ET_STYLE_MMSS, 90),
-					decor.Name(" ] "),
-					decor.EwmaSpeed(decor.UnitKiB, "% .2f", 60),
-					decor.Name(" "),
-				),
-			)
-			barReader := bar.ProxyReader(reader)
-			defer func() {
-				barReader.Close()
-				bar.Abort(true)
-			}()
-			reader = barReader
+// showResult lets the user know about a file once the engine has finished with it.
+func showResult(ctx context.Context, result *backup.Result) {
+	d := result.File
+	switch result.Type {
+	case backup.Downloaded:
+		notifyDownloaded(d, result.Previous)
+		if *progress {
+			log.Printf("%s: done", d.PlainName)
 		} else {
-			version := ""
-			if d.Version != "" {
-				version = " (version: " + color.Purple(d.Version) + ")"
-			}
-			fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green(displayPrefix+"/"+path.Join(basepath, filename)))
+			fmt.Fprintf(output, "%s: done\n", displayName(d))
 		}
+	case backup.Failed:
+		// Files which were cut short by the run being cancelled haven't really failed.
+		if ctx.Err() != nil {
+			return
+		}
+		notifier.Notify(&notify.Event{
+			Event:   notify.FileFailed,
+			Title:   "Unable to back up " + d.PlainName,
+			Message: fmt.Sprintf("%s for %s couldn't be backed up after %d attempts: %+v", d.PlainName, d.Game, result.Attempts, result.Err),
+			Game:    d.Game,
+			File:    d.PlainName,
+			Version: d.Version,
+		})
+	}
+}
 
-		defer readerTmp.Close()
-		if !*dryRun {
-			err = handler.TransferFile(reader, basepath, filename)
-
-			if err != nil {
-				writeLog(p, fmt.Sprintf("[%d] Unable to download file for %s%s (%s): %#v", attempt, d.PlainName, platform, d.URL, err))
-				return false
-			}
+func writeReport(runReport *report.Report, filename string) error {
+	if filename == "-" {
+		return runReport.Finish(os.Stdout)
+	}
 
-			if d.Version != "" {
-				// Save version information for next time.
-				err = handler.WriteFile(versionFile, d.Version)
-				if err != nil {
-					log.Printf("Unable to save version file: %+v", err)
-					// Good enough for this run through - we'll redownload next time and retry saving the version file then.
-					return true
-				}
-			}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = runReport.Finish(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-			if *progress {
-				log.Printf("%s%s: done", d.PlainName, platform)
-			} else {
-				fmt.Printf("%s: done\n", d.Name)
-			}
+// newBackend creates the backend for a -backend option, which may be a comma separated list of backends to mirror
+// files to.
+func newBackend(names string, uploadBucket *ratelimit.Bucket) (backend.Handler, error) {
+	var handlers []backend.Handler
+	for _, name := range strings.Split(names, ",") {
+		var handler backend.Handler
+		var err error
+		switch strings.TrimSpace(name) {
+		case "local":
+			handler = local.NewHandler()
+		case "s3":
+			handler, err = s3.NewHandler(uploadBucket)
+		case "sftp":
+			handler, err = sftp.NewHandler(uploadBucket)
+		default:
+			return nil, fmt.Errorf("Unknown backend (%s): valid values are; local, s3, sftp", name)
+		}
+		if err != nil {
+			return nil, err
 		}
+		handlers = append(handlers, handler)
+	}
 
-		// We successfully managed to download this file, skip the rest of our retries.
-		return true
+	if len(handlers) == 1 {
+		return handlers[0], nil
 	}
+	return mirror.NewHandler(handlers...), nil
+}
 
-	for d := range downloads {
-		basepath := d.File
-		if prefix != "" {
-			basepath = path.Join(prefix, basepath)
+// exitCode works out how the process should exit based on the outcome of a run.
+func exitCode(runReport *report.Report) int {
+	var authErr *gog.AuthError
+	for _, err := range append(runReport.RunErrors(), runReport.FileErrors()...) {
+		if errors.As(err, &authErr) {
+			return exitAuthFailure
 		}
-
-		for i := 1; i <= *retries; i++ {
-			if loop(d, i, basepath) {
-				if filesBar != nil {
-					filesBar.Increment()
-				}
+	}
+	// If nothing at all could be stored then it's the backend that needs looking at rather than any particular file.
+	if runReport.Failed > 0 && runReport.Downloaded == 0 {
+		backendFailed := true
+		var backendErr *backup.BackendError
+		for _, err := range runReport.FileErrors() {
+			if !errors.As(err, &backendErr) {
+				backendFailed = false
 				break
 			}
 		}
+		if backendFailed {
+			return exitBackendFailure
+		}
+	}
+	if runReport.Failed > 0 || len(runReport.Errors) > 0 {
+		return exitPartialFailure
+	}
+	return 0
+}
+
+// signalHandler calls stop when the first signal arrives so that current downloads can finish, then abort if they take
+// longer than -cleanup-timeout or another signal arrives.
+func signalHandler(stop context.CancelFunc, abort context.CancelFunc) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+
+	received := <-c
+	stop()
+	log.Printf("Received a %s signal, finishing downloads before closing.", received)
+	timeout := time.After(time.Second * time.Duration(*cleanupTimeout))
+	select {
+	case received = <-c:
+		log.Printf("Received a second %s signal, cancelling downloads in progress.", received)
+	case _ = <-timeout:
+		log.Printf("Cancelling downloads in progress after waiting %d seconds.", *cleanupTimeout)
 	}
+	abort()
 
-	waitGroup.Done()
+	// Everything should stop straight away now, but if anything is stuck then don't wait on it forever.
+	select {
+	case received = <-c:
+		log.Printf("Received a third %s signal, exiting immediately.", received)
+	case _ = <-time.After(time.Second * time.Duration(*cleanupTimeout)):
+		log.Printf("Exiting as downloads still haven't stopped %d seconds after being cancelled.", *cleanupTimeout)
+	}
+	os.Exit(1)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mscharley/gog-backup/internal/gog-backup/metrics"
+	"github.com/mscharley/gog-backup/internal/gog-backup/report"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backup"
+	"github.com/mscharley/gog-backup/pkg/gog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExitCode(t *testing.T) {
+	file := &backend.GogFile{Game: "Game", PlainName: "setup.exe"}
+	backendErr := &backup.BackendError{Err: errors.New("disk full")}
+
+	for name, test := range map[string]struct {
+		expected int
+		build    func(r *report.Report)
+	}{
+		"success": {0, func(r *report.Report) {
+			r.FileDownloaded(file, "setup.exe", 1)
+		}},
+		"some files failed": {exitPartialFailure, func(r *report.Report) {
+			r.FileDownloaded(file, "setup.exe", 1)
+			r.FileFailed(file, "patch.exe", errors.New("connection reset"))
+		}},
+		"backend down": {exitBackendFailure, func(r *report.Report) {
+			r.FileSkipped(file, "setup.exe", "up to date")
+			r.FileFailed(file, "patch.exe", backendErr)
+			r.FileFailed(file, "manual.pdf", backendErr)
+		}},
+		"backend failed for some files": {exitPartialFailure, func(r *report.Report) {
+			r.FileDownloaded(file, "setup.exe", 1)
+			r.FileFailed(file, "patch.exe", backendErr)
+		}},
+		"mixed failures": {exitPartialFailure, func(r *report.Report) {
+			r.FileFailed(file, "setup.exe", backendErr)
+			r.FileFailed(file, "patch.exe", errors.New("connection reset"))
+		}},
+		"auth failed during a download": {exitAuthFailure, func(r *report.Report) {
+			r.FileDownloaded(file, "setup.exe", 1)
+			r.FileFailed(file, "patch.exe", &gog.AuthError{Err: errors.New("invalid_grant")})
+		}},
+		"auth failed fetching the library": {exitAuthFailure, func(r *report.Report) {
+			r.RunError(&gog.AuthError{Err: errors.New("invalid_grant")})
+		}},
+	} {
+		r := report.New()
+		test.build(r)
+		if code := exitCode(r); code != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d", name, test.expected, code)
+		}
+	}
+}
+
+func TestRecordResult(t *testing.T) {
+	file := &backend.GogFile{Game: "Game", PlainName: "setup.exe"}
+	before := testutil.ToFloat64(metrics.Files.WithLabelValues("downloaded"))
+	recordResult(&backup.Result{Type: backup.Downloaded, File: file})
+	recordResult(&backup.Result{Type: backup.Filtered, File: file})
+	if count := testutil.ToFloat64(metrics.Files.WithLabelValues("downloaded")) - before; count != 1 {
+		t.Errorf("Expected 1 more downloaded file, got %g", count)
+	}
+	if count := testutil.CollectAndCount(metrics.Files); count > 1 {
+		t.Errorf("Filtered files shouldn't be counted, got %d states", count)
+	}
+}
+
+func TestReportToStdout(t *testing.T) {
+	flag.Set("report", "-")
+	defer flag.Set("report", "")
+	if consoleOutput() != os.Stderr {
+		t.Errorf("Everything else should go to stderr when the report is written to stdout")
+	}
+
+	file, err := ioutil.TempFile("", "gog-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	original := output
+	output = file
+	defer func() { output = original }()
+
+	writeLog(nil, "Unable to connect to GoG")
+	d := &display{}
+	d.update(&backup.Progress{Type: backup.TransferStarted, File: &backend.GogFile{PlainName: "setup.exe", URL: "https://embed.gog.com/downloads/game/en1installer0"}, Destination: "/tmp/setup.exe"})
+	written, _ := ioutil.ReadFile(file.Name())
+	if !strings.Contains(string(written), "Unable to connect to GoG") || !strings.Contains(string(written), "en1installer0") {
+		t.Errorf("Expected messages to be written to the console output, got %q", written)
+	}
+}
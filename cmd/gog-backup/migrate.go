@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/juju/ratelimit"
+	"github.com/mscharley/gog-backup/internal/gog-backup/metrics"
+	"github.com/mscharley/gog-backup/internal/gog-backup/state"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backend/crypt"
+)
+
+var (
+	migrateTo      = flag.String("migrate-to", "", "Which backend the migrate command should copy the backup in -backend to. Accepts the same values as -backend.")
+	migrateEncrypt = flag.Bool("migrate-encrypt", false, "Encrypt files as the migrate command copies them to -migrate-to. Use -encrypt if the existing backup is encrypted.")
+)
+
+// migration is the outcome of copying a backup from one backend to another.
+type migration struct {
+	copied  int
+	skipped int
+	failed  int
+	bytes   int64
+}
+
+// versionTarget finds the download which a version file belongs to.
+func versionTarget(marker string) string {
+	dir, base := path.Split(marker)
+	return dir + strings.TrimSuffix(strings.TrimPrefix(base, "."), ".version")
+}
+
+// relativeName strips a backend prefix from a file name returned by List().
+func relativeName(prefix string, name string) string {
+	if prefix = path.Clean(prefix); prefix == "." {
+		return name
+	}
+	return strings.TrimPrefix(path.Clean(name), prefix+"/")
+}
+
+// migrate copies every file in one backend to another. Downloads are copied first and the version files which mark
+// them as complete are only copied once their download has been verified, so an interrupted migration can simply be
+// run again and will pick up where it left off.
+//
+// Once finished is cancelled no more downloads are started, and once ctx is cancelled anything still in progress is
+// abandoned.
+func migrate(ctx context.Context, finished context.Context, source backend.Handler, destination backend.Handler, db *state.State) (*migration, error) {
+	sourcePrefix := source.GetPrefix()
+	destinationPrefix := destination.GetPrefix()
+	result := new(migration)
+
+	sourceFiles, err := source.List(ctx, sourcePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list files in %s: %+v", source.GetDisplayPrefix(), err)
+	}
+	destinationFiles, err := destination.List(ctx, destinationPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list files in %s: %+v", destination.GetDisplayPrefix(), err)
+	}
+	existing := make(map[string]int64, len(destinationFiles))
+	for _, file := range destinationFiles {
+		existing[relativeName(destinationPrefix, file.Name)] = file.Size
+	}
+
+	var markers []backend.FileInfo
+	failed := make(map[string]bool)
+	// copied are the downloads which are in the destination, which is only needed if we stop part way through.
+	copied := make(map[string]bool)
+	stopped := false
+	for _, file := range sourceFiles {
+		if finished.Err() != nil {
+			fmt.Fprintf(output, "Stopping before copying everything, run migrate again to finish.\n")
+			stopped = true
+			break
+		}
+		name := relativeName(sourcePrefix, file.Name)
+		if backend.IsPartial(name) {
+			continue
+		} else if backend.IsVersionMarker(name) {
+			markers = append(markers, file)
+			continue
+		}
+
+		target := path.Join(destinationPrefix, name)
+		entry := db.Lookup(state.Location(source, file.Name))
+		if size, ok := existing[name]; ok && size == file.Size && alreadyCopied(ctx, source, destination, file.Name, target, entry) {
+			result.skipped++
+			copied[name] = true
+			recordMigration(db, entry, destination, target)
+			continue
+		} else if *dryRun {
+			fmt.Fprintf(output, "Would copy %s (%d bytes).\n", name, file.Size)
+			continue
+		}
+
+		n, err := migrateFile(ctx, source, destination, file.Name, target, entry)
+		result.bytes += n
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to copy %s: %+v\n", name, err)
+			failed[name] = true
+			result.failed++
+			continue
+		}
+		fmt.Fprintf(output, "Copied %s (%d bytes).\n", name, n)
+		result.copied++
+		copied[name] = true
+		recordMigration(db, entry, destination, target)
+	}
+
+	for _, file := range markers {
+		if ctx.Err() != nil {
+			break
+		}
+		name := relativeName(sourcePrefix, file.Name)
+		if failed[versionTarget(name)] || (stopped && !copied[versionTarget(name)]) || *dryRun {
+			continue
+		}
+		target := path.Join(destinationPrefix, name)
+		version, err := source.ReadFile(ctx, file.Name)
+		if err == nil {
+			if current, _ := destination.ReadFile(ctx, target); current == version {
+				continue
+			}
+			err = destination.WriteFile(ctx, target, version)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to copy %s: %+v\n", name, err)
+			result.failed++
+		}
+	}
+
+	return result, nil
+}
+
+// alreadyCopied checks whether a file of the right size in the destination is a finished copy rather than one which
+// was left behind by something else. Version files are only copied once their download has been verified so a matching
+// one is enough, otherwise the copy has to match the checksum in the index.
+func alreadyCopied(ctx context.Context, source backend.Handler, destination backend.Handler, file string, target string, entry *state.Entry) bool {
+	marker := func(name string) string {
+		return path.Join(path.Dir(name), "."+path.Base(name)+".version")
+	}
+	if version, err := source.ReadFile(ctx, marker(file)); err == nil {
+		if current, err := destination.ReadFile(ctx, marker(target)); err == nil && current == version {
+			return true
+		}
+	}
+	if entry == nil || entry.MD5 == "" {
+		return false
+	}
+
+	reader, _, err := destination.OpenFile(ctx, target)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == entry.MD5
+}
+
+// migrateFile copies a single file between backends and verifies the copy.
+func migrateFile(ctx context.Context, source backend.Handler, destination backend.Handler, file string, target string, entry *state.Entry) (int64, error) {
+	reader, size, err := source.OpenFile(ctx, file)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	var details *backend.GogFile
+	if entry != nil {
+		details = &backend.GogFile{ProductID: entry.ProductID, Version: entry.Version}
+	}
+	hash := md5.New()
+	counter := &countingReader{Reader: io.TeeReader(reader, hash), metric: metrics.UploadedBytes, copies: int64(backend.Replicas(ctx, destination, path.Dir(target), path.Base(target), details))}
+	err = destination.TransferFile(ctx, counter, path.Dir(target), path.Base(target), details)
+	if err != nil {
+		return counter.count, err
+	}
+
+	if counter.count != size {
+		return counter.count, fmt.Errorf("Read %d bytes but expected %d", counter.count, size)
+	}
+	if entry != nil && entry.MD5 != "" && entry.Size == size {
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.MD5 {
+			return counter.count, fmt.Errorf("Checksum mismatch, expected %s but got %s", entry.MD5, sum)
+		}
+	}
+	copied, err := destination.Stat(ctx, target)
+	if err != nil {
+		return counter.count, err
+	}
+	if copied.Size != size {
+		return counter.count, fmt.Errorf("Copied %d bytes but expected %d", copied.Size, size)
+	}
+
+	return counter.count, nil
+}
+
+// countingReader counts how much of a file has been copied.
+type countingReader struct {
+	io.Reader
+	count int64
+	// metric is optional, if provided then it is kept up to date as well, counting every byte copies times.
+	metric *metrics.Bytes
+	copies int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	if r.metric != nil {
+		r.metric.Add(int64(n) * r.copies)
+	}
+	return n, err
+}
+
+// recordMigration adds a copied file to the index so that later backups to the new backend don't need to check it.
+func recordMigration(db *state.State, entry *state.Entry, destination backend.Handler, target string) {
+	location := state.Location(destination, target)
+	if entry == nil || db.Lookup(location) != nil {
+		return
+	}
+	copied := *entry
+	copied.File = target
+	copied.Location = location
+	if err := db.Record(&copied); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to save the index: %+v\n", err)
+	}
+}
+
+func migrateCommand(ctx context.Context, finished context.Context, source backend.Handler, uploadBucket *ratelimit.Bucket) {
+	if *migrateTo == "" {
+		fmt.Fprintf(os.Stderr, "Usage: gog-backup -backend <source> -migrate-to <destination> migrate\n")
+		os.Exit(1)
+	}
+	destination, err := newBackend(*migrateTo, uploadBucket)
+	if err == nil && *migrateEncrypt {
+		destination, err = crypt.NewHandler(destination)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading the backend (%s): %+v\n", *migrateTo, err)
+		os.Exit(exitBackendFailure)
+	}
+
+	db, err := state.Open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading the index: %+v\n", err)
+		os.Exit(1)
+	}
+	result, err := migrate(ctx, finished, source, destination, db)
+	if saveErr := db.Save(); saveErr != nil {
+		fmt.Fprintf(os.Stderr, "Unable to save the index: %+v\n", saveErr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(exitBackendFailure)
+	}
+
+	fmt.Fprintf(output, "Copied %d files (%d bytes), skipped %d files which were already copied.\n", result.copied, result.bytes, result.skipped)
+	if result.failed > 0 {
+		fmt.Fprintf(os.Stderr, "Failed to copy %d files, run migrate again to retry them.\n", result.failed)
+		os.Exit(exitPartialFailure)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mscharley/gog-backup/internal/gog-backup/state"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backend/local"
+)
+
+// dirHandler is a local backend in its own directory.
+type dirHandler struct {
+	backend.Handler
+	dir string
+	// transferred is called after every transfer.
+	transferred func()
+}
+
+func newDirHandler(t *testing.T) *dirHandler {
+	dir, err := ioutil.TempDir("", "gog-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &dirHandler{Handler: local.NewHandler(), dir: dir}
+}
+
+func (h *dirHandler) GetPrefix() string {
+	return h.dir
+}
+
+func (h *dirHandler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	err := h.Handler.TransferFile(ctx, reader, basepath, filename, source)
+	if h.transferred != nil {
+		h.transferred()
+	}
+	return err
+}
+
+func (h *dirHandler) write(t *testing.T, name string, content string) {
+	if err := os.MkdirAll(path.Dir(path.Join(h.dir, name)), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(h.dir, name), []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (h *dirHandler) read(name string) string {
+	content, _ := ioutil.ReadFile(path.Join(h.dir, name))
+	return string(content)
+}
+
+func TestMigrateResume(t *testing.T) {
+	flag.Set("state-file", "")
+	defer flag.Set("state-file", os.Getenv("HOME")+"/.gog-backup-state.json")
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	original := output
+	output = devNull
+	defer func() { output = original }()
+
+	db, err := state.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, destination := newDirHandler(t), newDirHandler(t)
+	for _, name := range []string{"a.exe", "b.exe", "c.exe"} {
+		source.write(t, "game/"+name, "installer "+name)
+		source.write(t, "game/."+name+".version", "1.0")
+	}
+	// Something the same size as c.exe which was never finished, so it has no version file.
+	destination.write(t, "game/c.exe", "half-copied.exe")
+
+	// Stop after the first download.
+	ctx := context.Background()
+	finished, stop := context.WithCancel(ctx)
+	defer stop()
+	destination.transferred = stop
+	result, err := migrate(ctx, finished, source, destination, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.copied != 1 {
+		t.Fatalf("Expected the first migration to stop after 1 file, copied %d", result.copied)
+	}
+	if destination.read("game/a.exe") != "installer a.exe" || destination.read("game/.a.exe.version") != "1.0" {
+		t.Errorf("Expected the first file to be copied along with its version")
+	}
+	if destination.read("game/.b.exe.version") != "" || destination.read("game/.c.exe.version") != "" {
+		t.Errorf("Expected no version files for downloads which weren't copied")
+	}
+
+	destination.transferred = nil
+	result, err = migrate(ctx, ctx, source, destination, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.skipped != 1 || result.copied != 2 || result.failed != 0 {
+		t.Errorf("Expected 1 file to be skipped and 2 copied, got %+v", result)
+	}
+	for _, name := range []string{"a.exe", "b.exe", "c.exe"} {
+		if content := destination.read("game/" + name); content != "installer "+name {
+			t.Errorf("Expected %s to be copied, got %q", name, content)
+		}
+		if version := destination.read("game/." + name + ".version"); version != "1.0" {
+			t.Errorf("Expected the version of %s to be copied, got %q", name, version)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mscharley/gog-backup/internal/gog-backup/notify"
+	"github.com/mscharley/gog-backup/internal/gog-backup/report"
+	"github.com/mscharley/gog-backup/internal/gog-backup/state"
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+var (
+	notifier   *notify.Notifier
+	notifyLock sync.Mutex
+	// knownProducts are the games and movies which had been backed up before the current run started.
+	knownProducts map[int64]bool
+	// announced are the games and movies which have already had a notification sent during the current run.
+	announced map[int64]bool
+)
+
+// startNotifications gets ready to announce new games and updates for a run.
+func startNotifications(db *state.State) {
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+
+	knownProducts = make(map[int64]bool)
+	announced = make(map[int64]bool)
+	for _, entry := range db.Entries() {
+		knownProducts[entry.ProductID] = true
+	}
+}
+
+// notifyDownloaded announces new games and updates to games, once per game for each run.
+//
+// Nothing is announced as new for the very first backup, as otherwise everything would be.
+func notifyDownloaded(d *backend.GogFile, previous string) {
+	notifyLock.Lock()
+	var event *notify.Event
+	if !announced[d.ProductID] {
+		if previous != "" && d.Version != "" && previous != d.Version {
+			event = &notify.Event{
+				Event:   notify.Update,
+				Title:   d.Game + " has been updated",
+				Message: fmt.Sprintf("%s for %s has been updated from %s to %s.", d.PlainName, d.Game, previous, d.Version),
+			}
+		} else if len(knownProducts) > 0 && !knownProducts[d.ProductID] {
+			event = &notify.Event{
+				Event:   notify.NewGame,
+				Title:   d.Game + " has been added to your library",
+				Message: fmt.Sprintf("%s has been added to your library and is being backed up.", d.Game),
+			}
+		}
+		announced[d.ProductID] = event != nil
+	}
+	notifyLock.Unlock()
+
+	if event != nil {
+		event.Game = d.Game
+		event.File = d.PlainName
+		event.Version = d.Version
+		notifier.Notify(event)
+	}
+}
+
+// notifyFinished sends a summary at the end of a run.
+func notifyFinished(runReport *report.Report) {
+	run := &notify.Run{
+		Downloaded: runReport.Downloaded,
+		Skipped:    runReport.Skipped,
+		Failed:     runReport.Failed,
+		Bytes:      runReport.Bytes,
+		Errors:     runReport.Errors,
+	}
+	message := fmt.Sprintf("Downloaded %d files (%d bytes), skipped %d files and %d files failed.", run.Downloaded, run.Bytes, run.Skipped, run.Failed)
+	if len(run.Errors) > 0 {
+		message += "\n\n" + strings.Join(run.Errors, "\n")
+	}
+
+	if exitCode(runReport) == 0 {
+		notifier.Notify(&notify.Event{Event: notify.RunFinished, Title: "Backup finished", Message: message, Run: run})
+	} else {
+		notifier.Notify(&notify.Event{Event: notify.RunFailed, Title: "Backup failed", Message: message, Run: run})
+	}
+}
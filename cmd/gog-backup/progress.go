@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bclicn/color"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backup"
+	"github.com/vbauerster/mpb/v5"
+	"github.com/vbauerster/mpb/v5/decor"
+)
+
+// display shows the progress of a run, either with progress bars or by printing each file as it is started if
+// -progress is disabled.
+type display struct {
+	progress  *mpb.Progress
+	gameBar   *mpb.Bar
+	filesBar  *mpb.Bar
+	lock      sync.Mutex
+	transfers map[*backend.GogFile]*transferBar
+}
+
+// transferBar is the progress bar for a single download.
+type transferBar struct {
+	bar  *mpb.Bar
+	last time.Time
+}
+
+func newDisplay() *display {
+	d := &display{transfers: make(map[*backend.GogFile]*transferBar)}
+	if !*progress {
+		return d
+	}
+
+	d.progress = mpb.New(
+		mpb.WithOutput(output),
+		mpb.PopCompletedMode(),
+		mpb.WithRefreshRate(250*time.Millisecond),
+	)
+	d.gameBar = d.progress.AddBar(1, mpb.BarStyle("[=>-]"),
+		mpb.BarNoPop(),
+		mpb.PrependDecorators(
+			decor.Name("Games processed "),
+			decor.CountersNoUnit("[%d / %d]"),
+		),
+	)
+	d.filesBar = d.progress.AddBar(1, mpb.BarStyle("[=>-]"),
+		mpb.BarNoPop(),
+		mpb.PrependDecorators(
+			decor.Name("Files processed "),
+			decor.CountersNoUnit("[%d / %d]"),
+		),
+	)
+	return d
+}
+
+// log implements backup.Options.OnLog. Debug messages go to the log package, which only shows them with -debug.
+func (d *display) log(level backup.LogLevel, message string) {
+	if level == backup.Debug {
+		log.Print(message)
+		return
+	}
+	writeLog(d.progress, message)
+}
+
+// displayName describes a file for the user, in colour.
+func displayName(d *backend.GogFile) string {
+	name := color.LightPurple(d.PlainName)
+	if d.Platform != "" {
+		name += " " + color.Red("["+d.Platform+"]")
+	}
+	if d.Language != "" {
+		name += " " + color.Cyan("["+d.Language+"]")
+	}
+	if d.Size != "" {
+		name += " " + color.LightYellow("["+d.Size+"]")
+	}
+	return name
+}
+
+// update implements backup.Options.OnProgress.
+func (d *display) update(event *backup.Progress) {
+	switch event.Type {
+	case backup.GamesProgress:
+		if d.gameBar != nil {
+			d.gameBar.SetCurrent(event.Current)
+			d.gameBar.SetTotal(event.Total, event.Final)
+		}
+	case backup.FilesProgress:
+		if d.filesBar != nil {
+			d.filesBar.SetCurrent(event.Current)
+			d.filesBar.SetTotal(event.Total, event.Final)
+		}
+	case backup.TransferStarted:
+		file := event.File
+		var platform string
+		if file.Platform != "" {
+			platform = " " + "[" + file.Platform + "]"
+		}
+		if d.progress == nil {
+			version := ""
+			if file.Version != "" {
+				version = " (version: " + color.Purple(file.Version) + ")"
+			}
+			fmt.Fprintf(output, "%s%s\n  %s -> %s\n", displayName(file), version, color.LightBlue(file.URL), color.Green(event.Destination))
+			return
+		}
+
+		bar := d.progress.AddBar(event.Total, mpb.BarStyle("[=>-|"),
+			mpb.BarNoPop(),
+			mpb.BarRemoveOnComplete(),
+			mpb.PrependDecorators(
+				decor.Name(fmt.Sprintf("[A%d] %s%s", event.Attempt, file.PlainName, platform)),
+				decor.CountersKibiByte(" [% .2f / % .2f]"),
+			),
+			mpb.AppendDecorators(
+				decor.EwmaETA(decor.ET_STYLE_MMSS, 90),
+				decor.Name(" ] "),
+				decor.EwmaSpeed(decor.UnitKiB, "% .2f", 60),
+				decor.Name(" "),
+			),
+		)
+		bar.SetCurrent(event.Current)
+		d.lock.Lock()
+		d.transfers[file] = &transferBar{bar, time.Now()}
+		d.lock.Unlock()
+	case backup.TransferProgress:
+		d.lock.Lock()
+		transfer := d.transfers[event.File]
+		d.lock.Unlock()
+		if transfer != nil {
+			transfer.bar.SetCurrent(event.Current)
+			transfer.bar.DecoratorEwmaUpdate(time.Since(transfer.last))
+			transfer.last = time.Now()
+		}
+	case backup.TransferFinished:
+		d.lock.Lock()
+		transfer := d.transfers[event.File]
+		delete(d.transfers, event.File)
+		d.lock.Unlock()
+		if transfer != nil {
+			transfer.bar.Abort(true)
+		}
+	}
+}
+
+// wait finishes off the progress bars at the end of a run.
+func (d *display) wait() {
+	if d.progress != nil {
+		d.gameBar.SetTotal(0, true)
+		d.filesBar.SetTotal(0, true)
+		d.progress.Wait()
+	}
+}
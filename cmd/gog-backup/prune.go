@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mscharley/gog-backup/internal/gog-backup/report"
+	"github.com/mscharley/gog-backup/internal/gog-backup/state"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/gog"
+	"github.com/vbauerster/mpb/v5"
+)
+
+var (
+	pruneGrace = flag.Duration("prune-grace", 7*24*time.Hour, "How long a file which GoG no longer ships must have been left untouched before the prune command will remove it.")
+)
+
+var (
+	pruneLock sync.Mutex
+	// pruneExpected lists the files which GoG currently ships for every folder in the backup that we know about.
+	pruneExpected = make(map[string]map[string]bool)
+	// pruneUnsafe lists the folders which we couldn't get a complete list of files for, either because GoG didn't tell
+	// us or because some of what GoG ships there was filtered out.
+	pruneUnsafe = make(map[string]bool)
+)
+
+// pruneTarget finds the download which a file in the backup belongs to. Version files and unfinished downloads belong to
+// the download they're named after.
+func pruneTarget(name string) string {
+	if backend.IsPartial(name) {
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "."), ".tmp")
+	}
+	if backend.IsVersionMarker(name) {
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "."), ".version")
+	}
+	return name
+}
+
+// pruneFile works out which files should be in the backup from the current details of a download.
+func pruneFile(ctx context.Context, p *mpb.Progress, client *gog.Client, d *backend.GogFile, basepath string) {
+	filename, _, err := client.StatFile(ctx, d.URL)
+	if err == nil && filename == "" {
+		err = fmt.Errorf("No filename available")
+	}
+	if err != nil {
+		writeLog(p, fmt.Sprintf("Unable to fetch file details from GoG for %s (%s), nothing will be pruned from %s: %+v", d.PlainName, d.URL, basepath, err))
+	}
+
+	pruneLock.Lock()
+	if pruneExpected[basepath] == nil {
+		pruneExpected[basepath] = make(map[string]bool)
+	}
+	if err != nil {
+		pruneUnsafe[basepath] = true
+	} else {
+		pruneExpected[basepath][filename] = true
+	}
+	pruneLock.Unlock()
+}
+
+// pruneFiltered marks a folder as containing files which were filtered out. These are still shipped by GoG, we just
+// don't know their names, so nothing can be safely removed from the folder.
+func pruneFiltered(basepath string) {
+	pruneLock.Lock()
+	pruneUnsafe[basepath] = true
+	pruneLock.Unlock()
+}
+
+// pruneOrphans removes files which GoG no longer ships from every folder that was checked by pruneFile.
+//
+// Only folders which GoG still lists downloads for are checked, and folders where anything was filtered out are skipped,
+// so nothing that GoG still ships is removed. Only files which are in the index are removed, anything else in the
+// backup wasn't put there by us. If any part of the library couldn't be fetched then orphaned files are only reported.
+func pruneOrphans(ctx context.Context, handler backend.Handler, db *state.State, runReport *report.Report) {
+	pruneLock.Lock()
+	defer pruneLock.Unlock()
+
+	remove := !*dryRun
+	if remove && len(runReport.RunErrors()) > 0 {
+		fmt.Fprintf(output, "Some of your library couldn't be fetched from GoG.com, orphaned files will be listed but not removed.\n")
+		remove = false
+	}
+
+	var dirs []string
+	for dir := range pruneExpected {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var count, recent, unknown int
+	var bytes int64
+	for _, dir := range dirs {
+		if pruneUnsafe[dir] {
+			continue
+		}
+		files, err := handler.List(ctx, dir)
+		if err != nil {
+			runReport.RunError(fmt.Errorf("Unable to list files in %s: %w", dir, err))
+			continue
+		}
+
+		for _, file := range files {
+			name := path.Base(file.Name)
+			// Subfolders are checked separately, if GoG still ships anything in them.
+			if path.Dir(file.Name) != path.Clean(dir) || pruneExpected[dir][pruneTarget(name)] {
+				continue
+			}
+			if db.Lookup(state.Location(handler, path.Join(dir, pruneTarget(name)))) == nil {
+				unknown++
+				continue
+			}
+			if time.Since(file.ModTime) < *pruneGrace {
+				recent++
+				continue
+			}
+
+			count++
+			bytes += file.Size
+			if !remove {
+				fmt.Fprintf(output, "Would remove %s (%d bytes, last modified %s).\n", file.Name, file.Size, file.ModTime.Format("2006-01-02"))
+				continue
+			}
+			if err = handler.Delete(ctx, file.Name); err != nil {
+				runReport.RunError(fmt.Errorf("Unable to remove %s: %w", file.Name, err))
+				continue
+			}
+			fmt.Fprintf(output, "Removed %s (%d bytes).\n", file.Name, file.Size)
+			if err = db.Forget(state.Location(handler, file.Name)); err != nil {
+				fmt.Fprintf(output, "Unable to save the index: %+v\n", err)
+			}
+		}
+	}
+
+	if remove {
+		fmt.Fprintf(output, "Removed %d files (%d bytes) which GoG no longer ships.\n", count, bytes)
+	} else {
+		fmt.Fprintf(output, "Found %d files (%d bytes) which GoG no longer ships.\n", count, bytes)
+	}
+	if recent > 0 {
+		fmt.Fprintf(output, "Kept %d files which were modified in the last %s.\n", recent, *pruneGrace)
+	}
+	if unknown > 0 {
+		fmt.Fprintf(output, "Kept %d files which aren't in the index, see import-state.\n", unknown)
+	}
+}
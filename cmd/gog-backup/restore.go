@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backend/crypt"
+)
+
+// restore copies a single file out of a backup, decrypting it if needed.
+func restore(ctx context.Context, handler backend.Handler, file string, destination string) error {
+	if prefix := handler.GetPrefix(); prefix != "" {
+		file = path.Join(prefix, file)
+	}
+	reader, _, err := handler.OpenFile(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, backend.NewContextReader(ctx, reader))
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a partially restored or unverified file lying around.
+		os.Remove(destination)
+	}
+	return err
+}
+
+func restoreCommand(ctx context.Context, handler backend.Handler) {
+	if flag.NArg() != 3 {
+		fmt.Fprintf(os.Stderr, "Usage: gog-backup restore <file in backup> <destination>\n")
+		os.Exit(1)
+	}
+	if err := restore(ctx, handler, flag.Arg(1), flag.Arg(2)); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to restore %s: %+v\n", flag.Arg(1), err)
+		os.Exit(1)
+	}
+}
+
+// decryptCommand decrypts a file which was copied out of an encrypted backup by some other means.
+func decryptCommand() {
+	var in io.Reader = os.Stdin
+	var out io.Writer = os.Stdout
+	if flag.NArg() > 3 {
+		fmt.Fprintf(os.Stderr, "Usage: gog-backup decrypt [input] [output]\n")
+		os.Exit(1)
+	}
+	if flag.NArg() > 1 && flag.Arg(1) != "-" {
+		file, err := os.Open(flag.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to decrypt: %+v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in = file
+	}
+	if flag.NArg() > 2 && flag.Arg(2) != "-" {
+		file, err := os.Create(flag.Arg(2))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to decrypt: %+v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := crypt.Decrypt(in, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to decrypt: %+v\n", err)
+		os.Exit(1)
+	}
+}
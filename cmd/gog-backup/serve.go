@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/mscharley/gog-backup/internal/gog-backup/lock"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+var (
+	lockFile       = flag.String("lock-file", os.Getenv("HOME")+"/.gog-backup.lock", "Where to keep a lock file which stops two runs from changing your backup at the same time. Set to an empty string to disable.")
+	schedule       = flag.Duration("schedule", 24*time.Hour, "How often the serve command should back up your library, eg. 12h.")
+	scheduleJitter = flag.Duration("schedule-jitter", 0, "Wait up to this much longer than -schedule between backups, chosen randomly each time, eg. 30m.")
+)
+
+// acquireLock takes the lock for commands which change the backup. Other commands are free to run at any time.
+func acquireLock(command string) (*lock.Lock, error) {
+	switch command {
+	case "backup", "serve", "import-state", "prune", "migrate":
+	default:
+		return nil, nil
+	}
+	if *lockFile == "" {
+		return nil, nil
+	}
+
+	l, err := lock.Acquire(*lockFile)
+	if err == lock.ErrLocked {
+		return nil, fmt.Errorf("Another run of gog-backup is already in progress (%s)", *lockFile)
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to lock %s: %+v", *lockFile, err)
+	}
+	return l, nil
+}
+
+// clock is how scheduled backups tell the time, so that tests don't have to wait for them.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// serve backs up the library on a schedule until finished is cancelled. The lock is held the whole time, so runs
+// started elsewhere can't overlap with a scheduled one.
+func serve(ctx context.Context, finished context.Context, client *gog.Client, backendHandler backend.Handler, downloadBucket *ratelimit.Bucket) {
+	if *schedule <= 0 {
+		fmt.Fprintf(os.Stderr, "-schedule must be greater than zero.\n")
+		os.Exit(1)
+	}
+	scheduled(finished, systemClock{}, func() {
+		runReport := run(ctx, finished, "backup", client, backendHandler, downloadBucket)
+		fmt.Fprintf(output, "Backup finished with %d files downloaded, %d skipped and %d failed.\n", runReport.Downloaded, runReport.Skipped, runReport.Failed)
+		for _, err := range runReport.RunErrors() {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+		}
+	})
+}
+
+// scheduled runs backup straight away, then again after every -schedule plus up to -schedule-jitter until finished is
+// cancelled.
+func scheduled(finished context.Context, c clock, backup func()) {
+	for {
+		fmt.Fprintf(output, "Starting a backup at %s.\n", c.Now().Format(time.RFC1123))
+		backup()
+
+		wait := *schedule
+		if *scheduleJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(*scheduleJitter)))
+		}
+		fmt.Fprintf(output, "Next backup at %s.\n", c.Now().Add(wait).Format(time.RFC1123))
+		select {
+		case <-finished.Done():
+			return
+		case <-c.After(wait):
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gog-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := *lockFile
+	flag.Set("lock-file", filepath.Join(dir, "gog-backup.lock"))
+	defer flag.Set("lock-file", original)
+
+	held, err := acquireLock("serve")
+	if err != nil || held == nil {
+		t.Fatalf("Expected to take the lock, got %+v", err)
+	}
+	defer held.Release()
+
+	if _, err = acquireLock("backup"); err == nil || !strings.Contains(err.Error(), "already in progress") {
+		t.Errorf("Expected a second run to be stopped while the lock is held, got %+v", err)
+	}
+	if l, err := acquireLock("restore"); l != nil || err != nil {
+		t.Errorf("Commands which don't change the backup shouldn't need the lock, got %v %+v", l, err)
+	}
+}
+
+// fakeClock never waits, and remembers how long it was asked to wait for.
+type fakeClock struct {
+	now   time.Time
+	waits []time.Duration
+	// fire is how many waits finish, any after that never do.
+	fire int
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	if len(c.waits) > c.fire {
+		return nil
+	}
+	c.now = c.now.Add(d)
+	fired := make(chan time.Time, 1)
+	fired <- c.now
+	return fired
+}
+
+func TestScheduled(t *testing.T) {
+	file, err := ioutil.TempFile("", "gog-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	original := output
+	output = file
+	defer func() { output = original }()
+	flag.Set("schedule", "12h")
+	defer flag.Set("schedule", "24h")
+
+	for _, jitter := range []time.Duration{0, 30 * time.Minute} {
+		flag.Set("schedule-jitter", jitter.String())
+		finished, stop := context.WithCancel(context.Background())
+		c := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), fire: 2}
+		backups := 0
+		scheduled(finished, c, func() {
+			backups++
+			if backups == 3 {
+				stop()
+			}
+		})
+		stop()
+
+		if backups != 3 || len(c.waits) != 3 {
+			t.Fatalf("Expected 3 backups with a wait after each, got %d backups and waits of %v", backups, c.waits)
+		}
+		for _, wait := range c.waits {
+			if wait < 12*time.Hour || wait > 12*time.Hour+jitter || (jitter == 0 && wait != 12*time.Hour) {
+				t.Errorf("Expected to wait between 12h and %s, got %s", 12*time.Hour+jitter, wait)
+			}
+		}
+	}
+	flag.Set("schedule-jitter", "0")
+
+	written, _ := ioutil.ReadFile(file.Name())
+	if !strings.Contains(string(written), "Next backup at Sat, 01 Jan 2022 12:00:00 UTC.") {
+		t.Errorf("Expected the next backup to be announced, got %q", written)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/bclicn/color"
+	"github.com/mscharley/gog-backup/internal/gog-backup/state"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/gog"
+	"github.com/vbauerster/mpb/v5"
+)
+
+var (
+	verifyLock     sync.Mutex
+	verifyChecked  int
+	verifyProblems = make(map[string]int)
+)
+
+func verifyProblem(p *mpb.Progress, problem string, d *backend.GogFile, platform string, detail string) {
+	verifyLock.Lock()
+	verifyProblems[problem]++
+	verifyLock.Unlock()
+
+	writeLog(p, fmt.Sprintf("%s %s%s: %s", color.Red("["+problem+"]"), d.PlainName, platform, detail))
+}
+
+// reportVerification prints a summary of a verification run and returns whether the backup is in good condition.
+func reportVerification() bool {
+	verifyLock.Lock()
+	defer verifyLock.Unlock()
+
+	total := 0
+	for _, count := range verifyProblems {
+		total += count
+	}
+	fmt.Fprintf(output, "Verified %d files, %d problems found.\n", verifyChecked, total)
+	for _, problem := range []string{"missing", "size", "checksum", "stale", "error"} {
+		if verifyProblems[problem] > 0 {
+			fmt.Fprintf(output, "  %s: %d\n", problem, verifyProblems[problem])
+		}
+	}
+	return total == 0
+}
+
+// verifyFile checks a single file in the backup against what GoG currently ships.
+func verifyFile(ctx context.Context, p *mpb.Progress, handler backend.Handler, client *gog.Client, db *state.State, d *backend.GogFile, basepath string) {
+	var platform string
+	if d.Platform != "" {
+		platform = " " + "[" + d.Platform + "]"
+	}
+
+	filename, size, err := client.StatFile(ctx, d.URL)
+	if err != nil {
+		verifyProblem(p, "error", d, platform, fmt.Sprintf("unable to fetch file details from GoG (%s): %+v", d.URL, err))
+		return
+	}
+
+	verifyLock.Lock()
+	verifyChecked++
+	verifyLock.Unlock()
+
+	file := path.Join(basepath, filename)
+	if exists, _ := handler.FileExists(ctx, file); !exists {
+		verifyProblem(p, "missing", d, platform, file)
+		return
+	}
+
+	reader, storedSize, err := handler.OpenFile(ctx, file)
+	if err != nil {
+		verifyProblem(p, "error", d, platform, fmt.Sprintf("unable to read %s: %+v", file, err))
+		return
+	}
+	defer reader.Close()
+	if size != nil && *size != storedSize {
+		verifyProblem(p, "size", d, platform, fmt.Sprintf("%s is %d bytes but GoG has %d bytes", file, storedSize, *size))
+		return
+	}
+
+	entry := db.Lookup(state.Location(handler, file))
+	if d.Version != "" {
+		lastVersion := ""
+		if entry != nil {
+			lastVersion = entry.Version
+		} else {
+			lastVersion, _ = handler.ReadFile(ctx, path.Join(basepath, "."+filename+".version"))
+		}
+		if lastVersion != d.Version {
+			verifyProblem(p, "stale", d, platform, fmt.Sprintf("%s is marked as version %q but GoG has version %q", file, lastVersion, d.Version))
+		}
+	}
+
+	if *checksums {
+		checksum, err := client.GetChecksum(ctx, d.URL)
+		if err != nil {
+			verifyProblem(p, "error", d, platform, fmt.Sprintf("unable to fetch checksum from GoG (%s): %+v", d.URL, err))
+			return
+		}
+		// GoG doesn't publish checksums for everything, but we may have recorded one ourselves.
+		if checksum == nil && entry != nil && entry.MD5 != "" {
+			checksum = &gog.FileChecksum{MD5: entry.MD5}
+		}
+		if checksum == nil {
+			return
+		}
+
+		hasher := md5.New()
+		if _, err = io.Copy(hasher, reader); err != nil {
+			verifyProblem(p, "error", d, platform, fmt.Sprintf("unable to read %s: %+v", file, err))
+			return
+		}
+		if sum := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(sum, checksum.MD5) {
+			verifyProblem(p, "checksum", d, platform, fmt.Sprintf("%s has checksum %s but GoG has %s", file, sum, checksum.MD5))
+		}
+	}
+}
@@ -8,6 +8,8 @@ require (
 	github.com/bclicn/color v0.0.0-20180711051946-108f2023dc84
 	github.com/juju/ratelimit v1.0.1
 	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/pkg/sftp v1.13.1
+	github.com/prometheus/client_golang v1.11.1
 	github.com/vbauerster/mpb v3.4.0+incompatible
 	github.com/vbauerster/mpb/v5 v5.4.0
 	github.com/vharitonsky/iniflags v0.0.0-20180513140207-a33cd0b5f3de
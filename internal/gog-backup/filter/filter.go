@@ -0,0 +1,244 @@
+package filter
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+var (
+	includeIDs        = flag.String("include-ids", "", "Comma separated list of product IDs to back up. (default: everything)")
+	excludeIDs        = flag.String("exclude-ids", "", "Comma separated list of product IDs to skip.")
+	includeTitles     = flag.String("include-titles", "", "Comma separated list of glob patterns for titles to back up, eg. \"The Witcher*\". (default: everything)")
+	excludeTitles     = flag.String("exclude-titles", "", "Comma separated list of glob patterns for titles to skip.")
+	includeTitleRegex = flag.String("include-title-regex", "", "A regular expression matching titles to back up. (default: everything)")
+	excludeTitleRegex = flag.String("exclude-title-regex", "", "A regular expression matching titles to skip.")
+	platforms         = flag.String("platforms", "", "Comma separated list of platforms to back up; windows, mac, linux. (default: all platforms)")
+	languages         = flag.String("languages", "", "Comma separated list of preferred languages to back up, eg. \"English\". (default: all languages)")
+	languageFallback  = flag.Bool("language-fallback", true, "Back up the first language GoG lists for games which aren't available in any of your preferred languages.")
+	includeExtraTypes = flag.String("include-extra-types", "", "Comma separated list of extra types to back up, eg. \"manuals,audio\". (default: all extras)")
+	excludeExtraTypes = flag.String("exclude-extra-types", "", "Comma separated list of extra types to skip, eg. \"video\".")
+)
+
+// Filter decides which parts of a library should be processed, based on the filtering flags.
+type Filter struct {
+	includeIDs        map[int64]bool
+	excludeIDs        map[int64]bool
+	includeTitles     []*regexp.Regexp
+	excludeTitles     []*regexp.Regexp
+	includeTitleRegex *regexp.Regexp
+	excludeTitleRegex *regexp.Regexp
+	platforms         map[string]bool
+	languages         map[string]bool
+	includeExtraTypes map[string]bool
+	excludeExtraTypes map[string]bool
+}
+
+// New creates a Filter from the filtering flags.
+func New() (*Filter, error) {
+	var err error
+	f := &Filter{
+		platforms:         toSet(splitList(*platforms)),
+		languages:         toSet(splitList(*languages)),
+		includeExtraTypes: toSet(splitList(*includeExtraTypes)),
+		excludeExtraTypes: toSet(splitList(*excludeExtraTypes)),
+	}
+
+	if f.includeIDs, err = parseIDs(*includeIDs); err != nil {
+		return nil, err
+	}
+	if f.excludeIDs, err = parseIDs(*excludeIDs); err != nil {
+		return nil, err
+	}
+	if f.includeTitles, err = compileGlobs(*includeTitles); err != nil {
+		return nil, err
+	}
+	if f.excludeTitles, err = compileGlobs(*excludeTitles); err != nil {
+		return nil, err
+	}
+	if *includeTitleRegex != "" {
+		if f.includeTitleRegex, err = regexp.Compile(*includeTitleRegex); err != nil {
+			return nil, err
+		}
+	}
+	if *excludeTitleRegex != "" {
+		if f.excludeTitleRegex, err = regexp.Compile(*excludeTitleRegex); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// Product decides whether a game or movie should be processed at all.
+func (f *Filter) Product(id int64, title string) bool {
+	if len(f.includeIDs) > 0 && !f.includeIDs[id] {
+		return false
+	}
+	if f.excludeIDs[id] {
+		return false
+	}
+	if len(f.includeTitles) > 0 && !matchAny(f.includeTitles, title) {
+		return false
+	}
+	if matchAny(f.excludeTitles, title) {
+		return false
+	}
+	if f.includeTitleRegex != nil && !f.includeTitleRegex.MatchString(title) {
+		return false
+	}
+	if f.excludeTitleRegex != nil && f.excludeTitleRegex.MatchString(title) {
+		return false
+	}
+	return true
+}
+
+// Platform decides whether downloads for a platform, eg. "Windows", should be processed.
+func (f *Filter) Platform(platform string) bool {
+	return len(f.platforms) == 0 || f.platforms[strings.ToLower(platform)]
+}
+
+// Language decides whether downloads for a language, eg. "English", should be processed.
+func (f *Filter) Language(language string) bool {
+	return len(f.languages) == 0 || f.languages[strings.ToLower(language)]
+}
+
+// Languages picks out the sets of downloads which should be processed from all of the languages available for a game.
+func (f *Filter) Languages(available []*gog.GameLanguages) []*gog.GameLanguages {
+	var result []*gog.GameLanguages
+	for _, language := range available {
+		if f.Language(language.Language) {
+			result = append(result, language)
+		}
+	}
+	if len(result) == 0 && len(available) > 0 && *languageFallback {
+		result = available[:1]
+	}
+	return result
+}
+
+// Extra decides whether extras of a given type, eg. "manuals", should be processed.
+func (f *Filter) Extra(extraType string) bool {
+	extraType = strings.ToLower(extraType)
+	if len(f.includeExtraTypes) > 0 && !f.includeExtraTypes[extraType] {
+		return false
+	}
+	return !f.excludeExtraTypes[extraType]
+}
+
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[strings.ToLower(item)] = true
+	}
+	return set
+}
+
+func parseIDs(list string) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	for _, item := range splitList(list) {
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid product ID (%s): %+v", item, err)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, title string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileGlobs(list string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, pattern := range splitList(list) {
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid title pattern (%s): %+v", pattern, err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// compileGlob turns a glob pattern into a case insensitive regular expression matching the whole of a title.
+//
+// This supports the same syntax as path.Match, except that titles aren't paths so "/" is an ordinary character which
+// "*" and "?" will match, eg. "Baldur's Gate*" matches "Baldur's Gate: Enhanced Edition / Siege of Dragonspear".
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("(?is)^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '\\':
+			i++
+			if i == len(runes) {
+				return nil, fmt.Errorf("trailing escape")
+			}
+			re.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case '[':
+			end := i + 1
+			if end < len(runes) && runes[end] == '^' {
+				end++
+			}
+			// An empty class isn't allowed, so a "]" straight away is part of it.
+			if end < len(runes) && runes[end] == ']' {
+				end++
+			}
+			for end < len(runes) && runes[end] != ']' {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			re.WriteString("[")
+			for j := i + 1; j < end; j++ {
+				switch {
+				case j == i+1 && runes[j] == '^':
+					re.WriteRune('^')
+				case runes[j] == '-':
+					re.WriteRune('-')
+				case runes[j] == '\\':
+					j++
+					re.WriteString(regexp.QuoteMeta(string(runes[j])))
+				default:
+					re.WriteString(regexp.QuoteMeta(string(runes[j])))
+				}
+			}
+			re.WriteString("]")
+			i = end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
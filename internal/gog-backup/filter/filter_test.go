@@ -0,0 +1,43 @@
+package filter
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		title   string
+		matched bool
+	}{
+		{"The Witcher*", "The Witcher 3: Wild Hunt", true},
+		{"the witcher*", "The Witcher 3: Wild Hunt", true},
+		{"The Witcher*", "Not The Witcher", false},
+		{"Baldur's Gate*", "Baldur's Gate: Enhanced Edition / Siege of Dragonspear", true},
+		{"*Siege*", "Baldur's Gate: Enhanced Edition / Siege of Dragonspear", true},
+		{"AC?DC", "AC/DC", true},
+		{"Fallout [1-3]", "Fallout 2", true},
+		{"Fallout [^1-3]", "Fallout 2", false},
+		{"Fallout [^1-3]", "Fallout 4", true},
+		{"Fallout [^1-3]", "Fallout /", true},
+		{"Star Wars: X-Wing (1993)", "Star Wars: X-Wing (1993)", true},
+		{"Question\\?", "Question?", true},
+		{"Question\\?", "Questions", false},
+		{"[]]", "]", true},
+	} {
+		re, err := compileGlob(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %+v", test.pattern, err)
+			continue
+		}
+		if matched := re.MatchString(test.title); matched != test.matched {
+			t.Errorf("%q matching %q: expected %v, got %v", test.pattern, test.title, test.matched, matched)
+		}
+	}
+}
+
+func TestCompileGlobInvalid(t *testing.T) {
+	for _, pattern := range []string{"[abc", "trailing\\", "[a\\"} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("%q should be rejected", pattern)
+		}
+	}
+}
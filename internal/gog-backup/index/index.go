@@ -0,0 +1,39 @@
+// Package index describes the files which have been backed up, separately from how the index of them is stored so
+// that it can be used without any of the command line flags.
+package index
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+// Entry is everything we know about a single file which has been backed up.
+type Entry struct {
+	ProductID int64     `json:"product_id"`
+	File      string    `json:"file"`
+	Version   string    `json:"version,omitempty"`
+	Size      int64     `json:"size"`
+	MD5       string    `json:"md5,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Location identifies both the backend and the file within it, see Location().
+	Location string `json:"location"`
+	// Source is the GoG URL the file was downloaded from, which stays the same when GoG renames a file in an update.
+	Source string `json:"source,omitempty"`
+}
+
+// Backend is the part of the entry's Location which identifies the backend it is stored in, the same as
+// Location(handler, "").
+func (e *Entry) Backend() string {
+	return strings.TrimSuffix(e.Location, e.File)
+}
+
+// Location is the key used to identify a file stored in a particular backend. Location(handler, "") identifies the
+// backend itself.
+func Location(handler backend.Handler, file string) string {
+	if prefix := handler.GetDisplayPrefix(); prefix != "" {
+		return prefix + "/" + file
+	}
+	return file
+}
@@ -0,0 +1,39 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked is returned when another process is already holding a lock.
+var ErrLocked = errors.New("Locked by another process")
+
+// Lock is an exclusive lock on a file which is held until it is released or the process exits.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes the lock on a file, creating the file if needed. If another process is holding the lock then this
+// fails with ErrLocked instead of waiting for it.
+func Acquire(path string) (*Lock, error) {
+	file, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The PID is only informational, to help track down whoever is holding the lock.
+	if err = file.Truncate(0); err == nil {
+		_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file}, nil
+}
+
+// Release gives up the lock.
+func (l *Lock) Release() error {
+	return l.file.Close()
+}
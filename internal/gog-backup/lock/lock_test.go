@@ -0,0 +1,37 @@
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gog-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gog-backup.lock")
+
+	first, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := Acquire(path); err != ErrLocked {
+		if second != nil {
+			second.Release()
+		}
+		t.Fatalf("Expected the lock to be held, got %+v", err)
+	}
+
+	if err = first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Expected the lock to be free once released, got %+v", err)
+	}
+	again.Release()
+}
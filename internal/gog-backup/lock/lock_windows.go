@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package lock
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is returned by Windows when a file is already open elsewhere without sharing.
+const errorSharingViolation syscall.Errno = 32
+
+func open(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Opening the file without sharing it stops anybody else from opening it until the handle is closed, including when
+	// the process dies.
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
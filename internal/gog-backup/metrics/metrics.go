@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// These are all of the metrics which are collected, using the Prometheus naming conventions.
+var (
+	DownloadedBytes = NewBytes("gog_backup_downloaded_bytes_total", "Bytes downloaded from GoG.")
+	UploadedBytes   = NewBytes("gog_backup_uploaded_bytes_total", "Bytes sent to the backend, counting every copy stored by a mirror.")
+	Files           = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "gog_backup_files_total", Help: "Files processed, by what happened to them."}, []string{"state"})
+	Retries         = prometheus.NewCounter(prometheus.CounterOpts{Name: "gog_backup_retries_total", Help: "Downloads which were retried after a failure."})
+	TokenRefreshes  = prometheus.NewCounter(prometheus.CounterOpts{Name: "gog_backup_token_refreshes_total", Help: "Access tokens requested from GoG."})
+	APIRequests     = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "gog_backup_api_request_duration_seconds", Help: "How long requests to the GoG API took to respond, by endpoint.", Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}}, []string{"endpoint"})
+	APIErrors       = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "gog_backup_api_errors_total", Help: "Requests to the GoG API which failed, by endpoint."}, []string{"endpoint"})
+	RateLimit       = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gog_backup_rate_limit_bytes_per_second", Help: "The configured rate limit, by direction."}, []string{"direction"})
+	Throughput      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gog_backup_throughput_bytes_per_second", Help: "Average transfer speed over the last 10 seconds, by direction."}, []string{"direction"})
+	LastRun         = prometheus.NewGauge(prometheus.GaugeOpts{Name: "gog_backup_last_run_timestamp_seconds", Help: "When the last run finished."})
+	LastSuccess     = prometheus.NewGauge(prometheus.GaugeOpts{Name: "gog_backup_last_success_timestamp_seconds", Help: "When the last run which backed up everything successfully finished."})
+)
+
+// Registry holds every metric above.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(DownloadedBytes, UploadedBytes, Files, Retries, TokenRefreshes, APIRequests, APIErrors, RateLimit, Throughput, LastRun, LastSuccess)
+}
+
+// Handler serves every metric in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve starts listening for requests for metrics in the background.
+func Serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go http.Serve(listener, mux)
+	go sampleThroughput()
+	return nil
+}
+
+// sampleThroughput keeps Throughput up to date.
+func sampleThroughput() {
+	const window = 10
+	var downloaded, uploaded [window + 1]int64
+	for i := 0; ; i++ {
+		downloaded[i%len(downloaded)] = DownloadedBytes.Total()
+		uploaded[i%len(uploaded)] = UploadedBytes.Total()
+		if i >= window {
+			oldest := (i + 1) % len(downloaded)
+			Throughput.WithLabelValues("download").Set(float64(downloaded[i%len(downloaded)]-downloaded[oldest]) / window)
+			Throughput.WithLabelValues("upload").Set(float64(uploaded[i%len(uploaded)]-uploaded[oldest]) / window)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Engine implements backup.Metrics.
+type Engine struct{}
+
+// Downloaded counts bytes downloaded from GoG.
+func (Engine) Downloaded(bytes int64) {
+	DownloadedBytes.Add(bytes)
+}
+
+// Uploaded counts bytes sent to the backend.
+func (Engine) Uploaded(bytes int64) {
+	UploadedBytes.Add(bytes)
+}
+
+// Retried counts downloads which are being tried again.
+func (Engine) Retried() {
+	Retries.Inc()
+}
+
+// Bytes is a counter of bytes transferred. It keeps its own total as well so that throughput can be sampled.
+type Bytes struct {
+	prometheus.Counter
+	total int64
+}
+
+// NewBytes creates a Bytes counter, which still needs to be registered.
+func NewBytes(name string, help string) *Bytes {
+	return &Bytes{Counter: prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})}
+}
+
+// Add increases the counter by n bytes.
+func (b *Bytes) Add(n int64) {
+	atomic.AddInt64(&b.total, n)
+	b.Counter.Add(float64(n))
+}
+
+// Total is how many bytes have been counted so far.
+func (b *Bytes) Total() int64 {
+	return atomic.LoadInt64(&b.total)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBytes(t *testing.T) {
+	b := NewBytes("test_bytes_total", "Bytes counted by a test.")
+	b.Add(100)
+	b.Add(23)
+	if b.Total() != 123 || testutil.ToFloat64(b) != 123 {
+		t.Errorf("Expected 123 bytes, got %d and %g", b.Total(), testutil.ToFloat64(b))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Files.WithLabelValues("downloaded").Inc()
+	APIRequests.WithLabelValues("games").Observe(0.3)
+	UploadedBytes.Add(42)
+
+	response := httptest.NewRecorder()
+	Handler().ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(response.Body)
+	for _, expected := range []string{
+		`gog_backup_files_total{state="downloaded"} 1`,
+		`gog_backup_api_request_duration_seconds_bucket{endpoint="games",le="0.5"} 1`,
+		`gog_backup_uploaded_bytes_total 42`,
+		`# TYPE gog_backup_last_run_timestamp_seconds gauge`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %s in:\n%s", expected, body)
+		}
+	}
+}
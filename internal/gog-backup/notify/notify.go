@@ -0,0 +1,344 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	events       = flag.String("notify-events", "run_failed,file_failed,new_game,update", "Comma separated list of events to send notifications for; run_finished, run_failed, file_failed, new_game, update.")
+	webhook      = flag.String("notify-webhook", "", "Send notifications to this URL as JSON in a POST request.")
+	ntfy         = flag.String("notify-ntfy", "", "Send notifications to this ntfy topic, eg. https://ntfy.sh/my-backups.")
+	gotify       = flag.String("notify-gotify", "", "Send notifications to this Gotify server, eg. https://gotify.example.com. See -notify-gotify-token.")
+	gotifyToken  = flag.String("notify-gotify-token", "", "The application token to use for -notify-gotify.")
+	smtpHost     = flag.String("notify-smtp-host", "", "Send notifications by email through this SMTP server, eg. smtp.example.com:587. See -notify-smtp-to.")
+	smtpUser     = flag.String("notify-smtp-user", "", "The username to log in to -notify-smtp-host with, if it needs one.")
+	smtpPassword = flag.String("notify-smtp-password", "", "The password to log in to -notify-smtp-host with.")
+	smtpFrom     = flag.String("notify-smtp-from", "gog-backup@localhost", "The address to send notification emails from.")
+	smtpTo       = flag.String("notify-smtp-to", "", "Comma separated list of addresses to send notification emails to.")
+)
+
+// These are the kinds of events that notifications are sent for.
+const (
+	RunFinished = "run_finished"
+	RunFailed   = "run_failed"
+	FileFailed  = "file_failed"
+	NewGame     = "new_game"
+	Update      = "update"
+)
+
+// Event is something that happened which somebody might want to hear about.
+type Event struct {
+	Event   string    `json:"event"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	Game    string    `json:"game,omitempty"`
+	File    string    `json:"file,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Run     *Run      `json:"run,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Run summarises a whole run, for RunFinished and RunFailed events.
+type Run struct {
+	Downloaded int      `json:"downloaded"`
+	Skipped    int      `json:"skipped"`
+	Failed     int      `json:"failed"`
+	Bytes      int64    `json:"bytes"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// Sink is somewhere that notifications can be sent.
+type Sink interface {
+	Send(event *Event) error
+}
+
+const (
+	// queueSize is how many events can be waiting to be sent before any more are dropped.
+	queueSize = 100
+	// closeTimeout is how long Close waits for events which haven't been sent yet.
+	closeTimeout = time.Minute
+)
+
+// Notifier sends events to every configured Sink. Events are sent in the background so that a slow sink doesn't hold
+// up a backup, call Close before exiting to make sure that they've all been sent.
+type Notifier struct {
+	sinks  []Sink
+	events map[string]bool
+	queue  chan *Event
+	done   chan struct{}
+	lock   sync.Mutex
+	closed bool
+}
+
+// New creates a Notifier from the notification flags. If no sinks are configured then events are quietly dropped.
+func New() (*Notifier, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	n := &Notifier{events: make(map[string]bool)}
+	for _, event := range strings.Split(*events, ",") {
+		switch event = strings.TrimSpace(event); event {
+		case RunFinished, RunFailed, FileFailed, NewGame, Update:
+			n.events[event] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("Unknown notification event (%s): valid values are; %s, %s, %s, %s, %s", event, RunFinished, RunFailed, FileFailed, NewGame, Update)
+		}
+	}
+
+	if *webhook != "" {
+		n.sinks = append(n.sinks, &WebhookSink{Client: client, URL: *webhook})
+	}
+	if *ntfy != "" {
+		n.sinks = append(n.sinks, &NtfySink{Client: client, URL: *ntfy})
+	}
+	if *gotify != "" {
+		if *gotifyToken == "" {
+			return nil, fmt.Errorf("-notify-gotify requires -notify-gotify-token")
+		}
+		n.sinks = append(n.sinks, &GotifySink{Client: client, URL: *gotify, Token: *gotifyToken})
+	}
+	if *smtpHost != "" {
+		var to []string
+		for _, address := range strings.Split(*smtpTo, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				to = append(to, address)
+			}
+		}
+		if len(to) == 0 {
+			return nil, fmt.Errorf("-notify-smtp-host requires -notify-smtp-to")
+		}
+		sink := &SMTPSink{Host: *smtpHost, Username: *smtpUser, Password: *smtpPassword, From: *smtpFrom, To: to}
+		if _, _, err := sink.addresses(); err != nil {
+			return nil, err
+		}
+		n.sinks = append(n.sinks, sink)
+	}
+
+	n.start()
+	return n, nil
+}
+
+// start sends events from the queue in the background.
+func (n *Notifier) start() {
+	n.queue = make(chan *Event, queueSize)
+	n.done = make(chan struct{})
+	go func() {
+		defer close(n.done)
+		for event := range n.queue {
+			for _, sink := range n.sinks {
+				if err := sink.Send(event); err != nil {
+					log.Printf("Unable to send a notification: %+v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close waits for any events which haven't been sent yet, up to closeTimeout. Anything notified afterwards is dropped.
+func (n *Notifier) Close() {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.queue)
+	n.lock.Unlock()
+
+	select {
+	case <-n.done:
+	case <-time.After(closeTimeout):
+		log.Printf("Gave up waiting for notifications to be sent.")
+	}
+}
+
+// Enabled checks whether anybody wants to hear about a kind of event.
+func (n *Notifier) Enabled(event string) bool {
+	return len(n.sinks) > 0 && n.events[event]
+}
+
+// Notify queues an event to be sent to every sink, if it is one of the events in -notify-events. Failures are logged
+// rather than returned as there isn't much else to be done about them.
+func (n *Notifier) Notify(event *Event) {
+	if !n.Enabled(event.Event) {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		log.Printf("Dropping a notification as notifications have already finished: %s", event.Title)
+		return
+	}
+	select {
+	case n.queue <- event:
+	default:
+		log.Printf("Dropping a notification as too many are waiting to be sent: %s", event.Title)
+	}
+}
+
+// WebhookSink POSTs events as JSON.
+type WebhookSink struct {
+	Client *http.Client
+	URL    string
+}
+
+// Send implements Sink.
+func (s *WebhookSink) Send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return post(s.Client, s.URL, "application/json", bytes.NewReader(body), nil)
+}
+
+// NtfySink publishes events to an ntfy topic.
+type NtfySink struct {
+	Client *http.Client
+	URL    string
+}
+
+// Send implements Sink.
+func (s *NtfySink) Send(event *Event) error {
+	headers := map[string]string{"Title": event.Title, "Tags": event.Event}
+	if event.Event == RunFailed || event.Event == FileFailed {
+		headers["Priority"] = "high"
+	}
+	return post(s.Client, s.URL, "text/plain; charset=utf-8", strings.NewReader(event.Message), headers)
+}
+
+// GotifySink sends events to a Gotify server.
+type GotifySink struct {
+	Client *http.Client
+	URL    string
+	Token  string
+}
+
+// Send implements Sink.
+func (s *GotifySink) Send(event *Event) error {
+	priority := 5
+	if event.Event == RunFailed || event.Event == FileFailed {
+		priority = 8
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    event.Title,
+		"message":  event.Message,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(s.URL, "/") + "/message?" + url.Values{"token": {s.Token}}.Encode()
+	return post(s.Client, endpoint, "application/json", bytes.NewReader(body), nil)
+}
+
+// SMTPSink sends events by email.
+type SMTPSink struct {
+	// Host includes the port, eg. smtp.example.com:587.
+	Host string
+	// Username and Password are optional, if provided then they're used to log in with PLAIN authentication.
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Send implements Sink.
+func (s *SMTPSink) Send(event *Event) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, strings.Split(s.Host, ":")[0])
+	}
+
+	from, to, err := s.addresses()
+	if err != nil {
+		return err
+	}
+	subject, err := header(event.Title)
+	if err != nil {
+		return err
+	}
+	var recipients, headerTo []string
+	for _, address := range to {
+		recipients = append(recipients, address.Address)
+		headerTo = append(headerTo, address.String())
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from.String(), strings.Join(headerTo, ", "), subject, event.Time.Format(time.RFC1123Z), strings.ReplaceAll(event.Message, "\n", "\r\n"))
+	return smtp.SendMail(s.Host, auth, from.Address, recipients, []byte(message))
+}
+
+// addresses parses From and To, which may include names, eg. "Backups <backups@example.com>".
+func (s *SMTPSink) addresses() (*mail.Address, []*mail.Address, error) {
+	from, err := parseAddress(s.From)
+	if err != nil {
+		return nil, nil, err
+	}
+	var to []*mail.Address
+	for _, address := range s.To {
+		parsed, err := parseAddress(address)
+		if err != nil {
+			return nil, nil, err
+		}
+		to = append(to, parsed)
+	}
+	return from, to, nil
+}
+
+func parseAddress(address string) (*mail.Address, error) {
+	if strings.ContainsAny(address, "\r\n") {
+		return nil, fmt.Errorf("Email address contains a line break: %q", address)
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid email address (%s): %+v", address, err)
+	}
+	return parsed, nil
+}
+
+// header makes a value safe to use in an email header, encoding anything which isn't plain ASCII. Line breaks would
+// allow extra headers to be added so they aren't allowed at all.
+func header(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("Email header contains a line break: %q", value)
+	}
+	return mime.QEncoding.Encode("utf-8", value), nil
+}
+
+func post(client *http.Client, URL string, contentType string, body io.Reader, headers map[string]string) error {
+	request, err := http.NewRequest("POST", URL, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		buf, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Unexpected status code from %s: %d\n%s", request.URL.Host, response.StatusCode, buf)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestNotifier(sinks ...Sink) *Notifier {
+	n := &Notifier{sinks: sinks, events: map[string]bool{RunFinished: true, RunFailed: true, FileFailed: true, NewGame: true, Update: true}}
+	n.start()
+	return n
+}
+
+// request is what a test HTTP server received.
+type request struct {
+	*http.Request
+	body []byte
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, <-chan *request) {
+	requests := make(chan *request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- &request{r, body}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestWebhook(t *testing.T) {
+	server, requests := newTestServer(t)
+	n := newTestNotifier(&WebhookSink{Client: server.Client(), URL: server.URL})
+	n.Notify(&Event{Event: Update, Title: "Some Game has been updated", Game: "Some Game", Version: "1.1"})
+	n.Close()
+
+	r := <-requests
+	var event Event
+	if err := json.Unmarshal(r.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" || event.Game != "Some Game" || event.Version != "1.1" || event.Time.IsZero() {
+		t.Errorf("Unexpected webhook: %s %s %s", r.Method, r.Header.Get("Content-Type"), r.body)
+	}
+}
+
+func TestNtfy(t *testing.T) {
+	server, requests := newTestServer(t)
+	n := newTestNotifier(&NtfySink{Client: server.Client(), URL: server.URL + "/my-backups"})
+	n.Notify(&Event{Event: FileFailed, Title: "Unable to back up setup.exe", Message: "Connection reset"})
+	n.Close()
+
+	r := <-requests
+	if r.URL.Path != "/my-backups" || r.Header.Get("Title") != "Unable to back up setup.exe" || r.Header.Get("Priority") != "high" || string(r.body) != "Connection reset" {
+		t.Errorf("Unexpected ntfy message: %s %v %s", r.URL, r.Header, r.body)
+	}
+}
+
+func TestGotify(t *testing.T) {
+	server, requests := newTestServer(t)
+	n := newTestNotifier(&GotifySink{Client: server.Client(), URL: server.URL + "/", Token: "secret"})
+	n.Notify(&Event{Event: RunFinished, Title: "Backup finished", Message: "Downloaded 1 file."})
+	n.Close()
+
+	r := <-requests
+	var message struct {
+		Title    string
+		Message  string
+		Priority int
+	}
+	if err := json.Unmarshal(r.body, &message); err != nil {
+		t.Fatal(err)
+	}
+	if r.URL.Path != "/message" || r.URL.Query().Get("token") != "secret" || message.Title != "Backup finished" || message.Priority != 5 {
+		t.Errorf("Unexpected Gotify message: %s %s", r.URL, r.body)
+	}
+}
+
+// email is what a fake SMTP server received.
+type email struct {
+	from string
+	to   []string
+	data string
+}
+
+// startSMTPServer accepts a single email, just enough of SMTP for net/smtp to be able to send it.
+func startSMTPServer(t *testing.T) (string, <-chan *email) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan *email, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ready")
+		m := new(email)
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "MAIL":
+				m.from = line[len("MAIL FROM:"):]
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				m.to = append(m.to, line[len("RCPT TO:"):])
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 Go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				m.data = string(data)
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 Bye")
+				received <- m
+				return
+			default:
+				text.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	host, received := startSMTPServer(t)
+	n := newTestNotifier(&SMTPSink{Host: host, From: "Backups <gog-backup@localhost>", To: []string{"me@example.com", "José <jose@example.com>"}})
+	n.Notify(&Event{Event: Update, Title: "Café Simulator has been updated", Message: "It's better now.\nProbably."})
+	n.Close()
+
+	var m *email
+	select {
+	case m = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No email was sent")
+	}
+	if m.from != "<gog-backup@localhost>" || strings.Join(m.to, ",") != "<me@example.com>,<jose@example.com>" {
+		t.Errorf("Unexpected envelope: %s %v", m.from, m.to)
+	}
+	for _, expected := range []string{
+		"From: \"Backups\" <gog-backup@localhost>\n",
+		"To: <me@example.com>, =?utf-8?q?Jos=C3=A9?= <jose@example.com>\n",
+		"Subject: =?utf-8?q?Caf=C3=A9_Simulator_has_been_updated?=\n",
+		"\nIt's better now.\nProbably.\n",
+	} {
+		if !strings.Contains(m.data, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, m.data)
+		}
+	}
+}
+
+func TestSMTPRejectsLineBreaks(t *testing.T) {
+	// Nothing should ever be sent, so there's no server to send to.
+	sink := &SMTPSink{Host: "127.0.0.1:1", From: "gog-backup@localhost", To: []string{"me@example.com"}}
+	if err := sink.Send(&Event{Title: "Some Game\r\nBcc: everyone@example.com"}); err == nil || !strings.Contains(err.Error(), "line break") {
+		t.Errorf("Expected a subject with a line break to be rejected, got %+v", err)
+	}
+	sink.To = []string{"me@example.com\r\nBcc: everyone@example.com"}
+	if err := sink.Send(&Event{Title: "Some Game"}); err == nil || !strings.Contains(err.Error(), "line break") {
+		t.Errorf("Expected an address with a line break to be rejected, got %+v", err)
+	}
+}
+
+// blockingSink doesn't finish sending anything until it's released.
+type blockingSink struct {
+	release chan struct{}
+	lock    sync.Mutex
+	sent    []*Event
+}
+
+func (s *blockingSink) Send(event *Event) error {
+	<-s.release
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent = append(s.sent, event)
+	return nil
+}
+
+func TestNotifyInBackground(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	n := newTestNotifier(sink)
+
+	returned := make(chan struct{})
+	go func() {
+		n.Notify(&Event{Event: NewGame, Title: "First"})
+		n.Notify(&Event{Event: NewGame, Title: "Second"})
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify waited for the sink")
+	}
+
+	close(sink.release)
+	n.Close()
+	if len(sink.sent) != 2 {
+		t.Errorf("Expected Close to wait for both events to be sent, got %d", len(sink.sent))
+	}
+	// Anything after Close is dropped rather than panicking.
+	n.Notify(&Event{Event: NewGame, Title: "Third"})
+	n.Close()
+}
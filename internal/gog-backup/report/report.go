@@ -0,0 +1,155 @@
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+// Report is a machine readable summary of everything that happened during a run.
+type Report struct {
+	Started    time.Time              `json:"started"`
+	Finished   time.Time              `json:"finished"`
+	Downloaded int                    `json:"downloaded"`
+	Skipped    int                    `json:"skipped"`
+	Failed     int                    `json:"failed"`
+	Bytes      int64                  `json:"bytes"`
+	Errors     []string               `json:"errors,omitempty"`
+	Games      map[string]*GameReport `json:"games"`
+
+	lock       sync.Mutex
+	runErrors  []error
+	fileErrors []error
+}
+
+// GameReport is the summary of all the files processed for a single game.
+type GameReport struct {
+	Bytes      int64         `json:"bytes"`
+	Downloaded []*FileResult `json:"downloaded,omitempty"`
+	Skipped    []*FileResult `json:"skipped,omitempty"`
+	Failed     []*FileResult `json:"failed,omitempty"`
+}
+
+// FileResult describes what happened to a single file.
+type FileResult struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+	Language string `json:"language,omitempty"`
+	Version  string `json:"version,omitempty"`
+	URL      string `json:"url"`
+	// Path is where the file was stored, or the folder it would have been stored in if we never found out its name.
+	Path   string `json:"path,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// New starts a new report.
+func New() *Report {
+	return &Report{
+		Started: time.Now(),
+		Games:   make(map[string]*GameReport),
+	}
+}
+
+func (r *Report) game(d *backend.GogFile) *GameReport {
+	game, ok := r.Games[d.Game]
+	if !ok {
+		game = new(GameReport)
+		r.Games[d.Game] = game
+	}
+	return game
+}
+
+func result(d *backend.GogFile, file string) *FileResult {
+	return &FileResult{
+		Name:     d.PlainName,
+		Platform: d.Platform,
+		Language: d.Language,
+		Version:  d.Version,
+		URL:      d.URL,
+		Path:     file,
+	}
+}
+
+// FileDownloaded records a file which was successfully backed up.
+func (r *Report) FileDownloaded(d *backend.GogFile, file string, bytes int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := result(d, file)
+	res.Bytes = bytes
+	game := r.game(d)
+	game.Downloaded = append(game.Downloaded, res)
+	game.Bytes += bytes
+	r.Downloaded++
+	r.Bytes += bytes
+}
+
+// FileSkipped records a file which didn't need to be backed up.
+func (r *Report) FileSkipped(d *backend.GogFile, file string, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := result(d, file)
+	res.Reason = reason
+	game := r.game(d)
+	game.Skipped = append(game.Skipped, res)
+	r.Skipped++
+}
+
+// FileFailed records a file which couldn't be backed up.
+func (r *Report) FileFailed(d *backend.GogFile, file string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := result(d, file)
+	if err != nil {
+		res.Reason = err.Error()
+		r.fileErrors = append(r.fileErrors, err)
+	}
+	game := r.game(d)
+	game.Failed = append(game.Failed, res)
+	r.Failed++
+}
+
+// RunError records a problem which wasn't caused by any single file, such as being unable to fetch the library.
+func (r *Report) RunError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Errors = append(r.Errors, err.Error())
+	r.runErrors = append(r.runErrors, err)
+}
+
+// RunErrors returns all of the errors passed to RunError().
+func (r *Report) RunErrors() []error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]error(nil), r.runErrors...)
+}
+
+// FileErrors returns all of the errors passed to FileFailed().
+func (r *Report) FileErrors() []error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]error(nil), r.fileErrors...)
+}
+
+// Finish marks the end of the run and writes the report out as JSON.
+func (r *Report) Finish(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Finished = time.Now()
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
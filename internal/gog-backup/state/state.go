@@ -0,0 +1,188 @@
+package state
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mscharley/gog-backup/internal/gog-backup/index"
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+var (
+	stateFile = flag.String("state-file", os.Getenv("HOME")+"/.gog-backup-state.json", "Where to keep the index of files which have been backed up. Set to an empty string to disable.")
+)
+
+// How often to write the index out to disk while files are being recorded.
+const saveInterval = 30 * time.Second
+
+// Entry is everything we know about a single file which has been backed up.
+type Entry = index.Entry
+
+// State is an index of every file which has been backed up, used to decide what needs to be backed up without needing
+// to ask the backend.
+type State struct {
+	Files map[string]*Entry `json:"files"`
+
+	// sources finds the latest entry for each source in each backend.
+	sources  map[string]*Entry
+	path     string
+	lock     sync.Mutex
+	dirty    bool
+	lastSave time.Time
+}
+
+// Location is the key used to identify a file stored in a particular backend, see index.Location().
+func Location(handler backend.Handler, file string) string {
+	return index.Location(handler, file)
+}
+
+// Open loads the index from the file given by -state-file. If the index is disabled then it will only be kept in
+// memory for the current run.
+func Open() (*State, error) {
+	s := &State{
+		Files:    make(map[string]*Entry),
+		sources:  make(map[string]*Entry),
+		path:     *stateFile,
+		lastSave: time.Now(),
+	}
+	if s.path == "" {
+		return s, nil
+	}
+
+	buf, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]*Entry)
+	}
+	for _, entry := range s.Files {
+		if entry.Source == "" {
+			continue
+		}
+		key := entry.Backend() + entry.Source
+		if latest := s.sources[key]; latest == nil || latest.Timestamp.Before(entry.Timestamp) {
+			s.sources[key] = entry
+		}
+	}
+
+	return s, nil
+}
+
+// Lookup returns what we know about a file, or nil if it isn't in the index.
+func (s *State) Lookup(location string) *Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Files[location]
+}
+
+// LookupSource returns the latest file which was downloaded from a GoG URL into a backend, whatever it was called, or
+// nil if there isn't one. backend is Location(handler, "").
+func (s *State) LookupSource(backend string, source string) *Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.sources[backend+source]
+}
+
+// Entries returns everything in the index, sorted by location.
+func (s *State) Entries() []*Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := make([]*Entry, 0, len(s.Files))
+	for _, entry := range s.Files {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Location < entries[j].Location })
+	return entries
+}
+
+// Record adds or updates a file in the index.
+func (s *State) Record(entry *Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	s.Files[entry.Location] = entry
+	if entry.Source != "" {
+		s.sources[entry.Backend()+entry.Source] = entry
+	}
+	s.dirty = true
+	return s.saveIfDue()
+}
+
+// Forget removes a file from the index.
+func (s *State) Forget(location string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.Files[location]
+	if !ok {
+		return nil
+	}
+	delete(s.Files, location)
+	if key := entry.Backend() + entry.Source; s.sources[key] == entry {
+		delete(s.sources, key)
+	}
+	s.dirty = true
+	return s.saveIfDue()
+}
+
+// Save writes the index out to disk if anything has changed.
+func (s *State) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.save()
+}
+
+func (s *State) saveIfDue() error {
+	if time.Since(s.lastSave) < saveInterval {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *State) save() error {
+	s.lastSave = time.Now()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpfile := s.path + ".tmp"
+	err = ioutil.WriteFile(tmpfile, buf, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpfile, s.path)
+	if err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,340 @@
+package crypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	keyFile    = flag.String("encrypt-key-file", "", "A file containing a 32 byte key, either raw or hex encoded, used to encrypt backups. (encrypt=true)")
+	passphrase = flag.String("encrypt-passphrase", "", "A passphrase used to encrypt backups, if -encrypt-key-file isn't provided. (default: $GOG_BACKUP_PASSPHRASE) (encrypt=true)")
+)
+
+type handler struct {
+	inner backend.Handler
+	key   *masterKey
+}
+
+// masterKey is the key that the key for each file is derived from. Keys from a passphrase depend on a salt which is
+// stored in the header of every file, a new one is picked for each run and the key for any other salt is derived
+// again when a file which used it is read.
+type masterKey struct {
+	// key is used as is when it doesn't come from a passphrase.
+	key        []byte
+	passphrase []byte
+	// salt is used for everything encrypted by this run.
+	salt    []byte
+	lock    sync.Mutex
+	derived map[string][]byte
+}
+
+func newMasterKey(key []byte, passphrase []byte) (*masterKey, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	m := &masterKey{key: key, passphrase: passphrase, salt: salt, derived: make(map[string][]byte)}
+	// Deriving the key up front means a run doesn't stall on it part way through the first file.
+	if _, err := m.forSalt(salt); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// forSalt returns the key for a file which was encrypted with a passphrase salt.
+func (m *masterKey) forSalt(salt []byte) ([]byte, error) {
+	if m.passphrase == nil {
+		return m.key, nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if key, ok := m.derived[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key(m.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	m.derived[string(salt)] = key
+	return key, nil
+}
+
+// NewHandler wraps another backend so that everything it stores is encrypted first.
+//
+// Only the content of files is encrypted, their names are left as is.
+func NewHandler(inner backend.Handler) (backend.Handler, error) {
+	key, err := loadKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &handler{
+		inner: inner,
+		key:   key,
+	}, nil
+}
+
+func loadKey() (*masterKey, error) {
+	if *keyFile != "" {
+		contents, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(contents) == 32 {
+			return newMasterKey(contents, nil)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("The key in %s must be 32 bytes, either raw or hex encoded", *keyFile)
+		}
+		return newMasterKey(key, nil)
+	}
+
+	// The passphrase is read from the environment here rather than being the flag's default so that it never turns up
+	// in -help.
+	pass := *passphrase
+	if pass == "" {
+		pass = os.Getenv("GOG_BACKUP_PASSPHRASE")
+	}
+	if pass != "" {
+		return newMasterKey(nil, []byte(pass))
+	}
+
+	return nil, fmt.Errorf("Encryption requires either -encrypt-key-file, -encrypt-passphrase or $GOG_BACKUP_PASSPHRASE")
+}
+
+// aead creates the cipher for a single file, based on the salts stored in its header.
+func (h *handler) aead(salts []byte) (cipher.AEAD, error) {
+	master, err := h.key.forSalt(salts[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, salts[saltSize:], []byte("gog-backup file key")), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (h *handler) encrypt(reader io.Reader) (io.Reader, error) {
+	salts := make([]byte, 2*saltSize)
+	copy(salts, h.key.salt)
+	if _, err := rand.Read(salts[saltSize:]); err != nil {
+		return nil, err
+	}
+	aead, err := h.aead(salts)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptReader(reader, aead, salts), nil
+}
+
+func (h *handler) decrypt(reader io.Reader) (io.Reader, error) {
+	salts, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := h.aead(salts)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(reader, aead), nil
+}
+
+// Replicas implements backend.Replicator for the inner backend.
+func (h *handler) Replicas(ctx context.Context, basepath string, filename string, source *backend.GogFile) int {
+	return backend.Replicas(ctx, h.inner, basepath, filename, source)
+}
+
+func (h *handler) GetPrefix() string {
+	return h.inner.GetPrefix()
+}
+
+func (h *handler) GetDisplayPrefix() string {
+	return h.inner.GetDisplayPrefix()
+}
+
+func (h *handler) ReadFile(ctx context.Context, filename string) (string, error) {
+	contents, err := h.inner.ReadFile(ctx, filename)
+	if err != nil {
+		return "", err
+	}
+	reader, err := h.decrypt(strings.NewReader(contents))
+	if err != nil {
+		return "", err
+	}
+	plain, err := ioutil.ReadAll(reader)
+	return string(plain), err
+}
+
+func (h *handler) WriteFile(ctx context.Context, filename string, content string) error {
+	reader, err := h.encrypt(strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+	sealed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return h.inner.WriteFile(ctx, filename, string(sealed))
+}
+
+func (h *handler) FileExists(ctx context.Context, filename string) (bool, error) {
+	return h.inner.FileExists(ctx, filename)
+}
+
+func (h *handler) OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	file, size, err := h.inner.OpenFile(ctx, filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	reader, err := h.decrypt(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, file}, plaintextSize(size), nil
+}
+
+func (h *handler) Stat(ctx context.Context, filename string) (*backend.FileInfo, error) {
+	info, err := h.inner.Stat(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = plaintextSize(info.Size)
+	return info, nil
+}
+
+func (h *handler) Delete(ctx context.Context, filename string) error {
+	return h.inner.Delete(ctx, filename)
+}
+
+func (h *handler) Rename(ctx context.Context, oldname string, newname string) error {
+	return h.inner.Rename(ctx, oldname, newname)
+}
+
+func (h *handler) List(ctx context.Context, prefix string) ([]backend.FileInfo, error) {
+	files, err := h.inner.List(ctx, prefix)
+	for i := range files {
+		files[i].Size = plaintextSize(files[i].Size)
+	}
+	return files, err
+}
+
+func (h *handler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	sealed, err := h.encrypt(reader)
+	if err != nil {
+		return err
+	}
+	return h.inner.TransferFile(ctx, sealed, basepath, filename, source)
+}
+
+// PartialSize implements backend.Resumer, if the inner backend does. Only whole chunks of an interrupted transfer can be
+// continued from, anything after the last whole chunk is written again when the transfer is resumed.
+func (h *handler) PartialSize(ctx context.Context, basepath string, filename string) (int64, error) {
+	resumer, ok := h.inner.(backend.Resumer)
+	if !ok {
+		return 0, nil
+	}
+	size, err := resumer.PartialSize(ctx, basepath, filename)
+	if err != nil {
+		return 0, err
+	}
+	return resumableSize(size), nil
+}
+
+func (h *handler) OpenPartial(ctx context.Context, basepath string, filename string) (io.ReadCloser, error) {
+	resumer, ok := h.inner.(backend.Resumer)
+	if !ok {
+		return nil, fmt.Errorf("Resuming transfers isn't supported by this backend")
+	}
+	size, err := resumer.PartialSize(ctx, basepath, filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := resumer.OpenPartial(ctx, basepath, filename)
+	if err != nil {
+		return nil, err
+	}
+	// There's no final chunk yet, so stop at the end of the last whole one.
+	sealed := io.LimitReader(file, sealedOffset(resumableSize(size)))
+	salts, err := readHeader(sealed)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	aead, err := h.aead(salts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{newPartialDecryptReader(sealed, aead), file}, nil
+}
+
+// ResumeFile implements backend.Resumer. offset must be at the end of a whole chunk, as returned by PartialSize.
+func (h *handler) ResumeFile(ctx context.Context, reader io.Reader, basepath string, filename string, offset int64) error {
+	resumer, ok := h.inner.(backend.Resumer)
+	if !ok {
+		return fmt.Errorf("Resuming transfers isn't supported by this backend")
+	}
+	if offset%chunkSize != 0 {
+		return fmt.Errorf("Encrypted transfers can only be resumed at the end of a chunk, not from byte %d", offset)
+	}
+
+	// The rest of the file needs to be encrypted with the same key as what's already there.
+	partial, err := resumer.OpenPartial(ctx, basepath, filename)
+	if err != nil {
+		return err
+	}
+	salts, err := readHeader(partial)
+	partial.Close()
+	if err != nil {
+		return err
+	}
+	aead, err := h.aead(salts)
+	if err != nil {
+		return err
+	}
+	sealed := newResumeEncryptReader(reader, aead, uint64(offset/chunkSize))
+	return resumer.ResumeFile(ctx, sealed, basepath, filename, sealedOffset(offset))
+}
+
+// Decrypt decrypts a file which was encrypted by this backend, without needing access to the backend it was stored in.
+func Decrypt(reader io.Reader, writer io.Writer) error {
+	key, err := loadKey()
+	if err != nil {
+		return err
+	}
+	h := &handler{key: key}
+	plain, err := h.decrypt(reader)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, plain)
+	return err
+}
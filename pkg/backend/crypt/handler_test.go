@@ -0,0 +1,183 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backend/local"
+)
+
+func newTestHandler(t *testing.T) (*handler, string) {
+	dir, err := ioutil.TempDir("", "gog-crypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &handler{inner: local.NewHandler(), key: newTestKey(t)}, dir
+}
+
+func newTestKey(t *testing.T) *masterKey {
+	key, err := newMasterKey(bytes.Repeat([]byte{7}, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// failAfter stops with an error after reading n bytes, like a download which was interrupted.
+type failAfter struct {
+	r io.Reader
+	n int
+}
+
+func (f *failAfter) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestResume(t *testing.T) {
+	ctx := context.Background()
+	h, dir := newTestHandler(t)
+	content := make([]byte, 3*chunkSize+1234)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	// Interrupt the transfer part way through the third chunk.
+	err := h.TransferFile(ctx, &failAfter{bytes.NewReader(content), 2*chunkSize + 100}, dir, "setup.exe", nil)
+	if err == nil {
+		t.Fatal("Expected the transfer to fail")
+	}
+
+	offset, err := h.PartialSize(ctx, dir, "setup.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset%chunkSize != 0 || offset == 0 || offset > 2*chunkSize+100 {
+		t.Fatalf("Expected to resume from the end of a whole chunk, got %d", offset)
+	}
+
+	partial, err := h.OpenPartial(ctx, dir, "setup.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := ioutil.ReadAll(partial)
+	partial.Close()
+	if err != nil {
+		t.Fatalf("Unable to read back the partial transfer: %+v", err)
+	}
+	if !bytes.Equal(recovered, content[:offset]) {
+		t.Fatalf("Partial transfer doesn't match, got %d bytes", len(recovered))
+	}
+
+	if err = h.ResumeFile(ctx, bytes.NewReader(content[offset:]), dir, "setup.exe", offset); err != nil {
+		t.Fatalf("Unable to resume: %+v", err)
+	}
+	file, size, err := h.OpenFile(ctx, dir+"/setup.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	result, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Unable to decrypt the resumed file: %+v", err)
+	}
+	if !bytes.Equal(result, content) || size != int64(len(content)) {
+		t.Errorf("Resumed file doesn't match, got %d bytes (size %d)", len(result), size)
+	}
+}
+
+func TestResumeUnaligned(t *testing.T) {
+	h, dir := newTestHandler(t)
+	if err := h.ResumeFile(context.Background(), bytes.NewReader(nil), dir, "setup.exe", 100); err == nil {
+		t.Errorf("Expected resuming from the middle of a chunk to fail")
+	}
+}
+
+func TestResumeUnsupported(t *testing.T) {
+	h := &handler{inner: struct{ backend.Handler }{local.NewHandler()}, key: newTestKey(t)}
+	if size, err := h.PartialSize(context.Background(), "", "setup.exe"); size != 0 || err != nil {
+		t.Errorf("Expected nothing to resume, got %d %+v", size, err)
+	}
+}
+
+func TestPassphraseFromEnvironment(t *testing.T) {
+	if flag.Lookup("encrypt-passphrase").DefValue != "" {
+		t.Errorf("The passphrase shouldn't be the default of a flag, where it would be shown by -help")
+	}
+	os.Setenv("GOG_BACKUP_PASSPHRASE", "correct horse battery staple")
+	defer os.Unsetenv("GOG_BACKUP_PASSPHRASE")
+	fromEnv, err := loadKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flag.Set("encrypt-passphrase", "correct horse battery staple")
+	defer flag.Set("encrypt-passphrase", "")
+	fromFlag, err := loadKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fromEnv.passphrase) != string(fromFlag.passphrase) {
+		t.Errorf("The same passphrase should be used from either place")
+	}
+}
+
+func TestPassphraseSalt(t *testing.T) {
+	first, err := newMasterKey(nil, []byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newMasterKey(nil, []byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstKey, _ := first.forSalt(first.salt)
+	secondKey, _ := second.forSalt(second.salt)
+	if bytes.Equal(first.salt, second.salt) || bytes.Equal(firstKey, secondKey) {
+		t.Errorf("Every run should derive its key from the passphrase with a new salt")
+	}
+
+	// Anything encrypted by one run can still be read by another, as the salt is kept in the header.
+	sealed, err := (&handler{key: first}).encrypt(strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, _ := ioutil.ReadAll(sealed)
+	if !bytes.Equal(encrypted[len(magic):len(magic)+saltSize], first.salt) {
+		t.Errorf("Expected the passphrase salt to be stored in the header")
+	}
+	plain, err := (&handler{key: second}).decrypt(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadAll(plain); string(contents) != "hello world" || err != nil {
+		t.Errorf("Unable to decrypt with the same passphrase in a later run: %q %+v", contents, err)
+	}
+
+	wrong, err := newMasterKey(nil, []byte("incorrect horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err = (&handler{key: wrong}).decrypt(bytes.NewReader(encrypted))
+	if err == nil {
+		_, err = ioutil.ReadAll(plain)
+	}
+	if err == nil {
+		t.Errorf("Expected decrypting with the wrong passphrase to fail")
+	}
+}
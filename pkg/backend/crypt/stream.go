@@ -0,0 +1,167 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Encrypted files are made up of a header followed by the content broken up into chunks, each of which is sealed with
+// AES-256-GCM. The nonce for each chunk is its position in the file along with a flag marking the final chunk, so
+// chunks can't be reordered, dropped or truncated without it being noticed.
+//
+// The header is the magic followed by two salts; the first is used to turn a passphrase into a key and the second is
+// used to derive a key for the file from that.
+const (
+	magic      = "GOGBAK1\n"
+	saltSize   = 16
+	headerSize = len(magic) + 2*saltSize
+	chunkSize  = 64 * 1024
+	tagSize    = 16
+	nonceSize  = 12
+)
+
+// plaintextSize works out how large the content of an encrypted file is from the size of the encrypted file.
+func plaintextSize(size int64) int64 {
+	size -= int64(headerSize)
+	if size < tagSize {
+		return 0
+	}
+	chunks := (size + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return size - chunks*tagSize
+}
+
+// resumableSize works out how much content can be recovered from an interrupted transfer, which is every chunk that
+// was written in full.
+func resumableSize(size int64) int64 {
+	size -= int64(headerSize)
+	if size < 0 {
+		return 0
+	}
+	return size / (chunkSize + tagSize) * chunkSize
+}
+
+// sealedOffset works out where content at offset starts in an encrypted file. offset must be at the start of a chunk.
+func sealedOffset(offset int64) int64 {
+	return int64(headerSize) + offset/chunkSize*(chunkSize+tagSize)
+}
+
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(n[nonceSize-9:nonceSize-1], counter)
+	if last {
+		n[nonceSize-1] = 1
+	}
+	return n
+}
+
+// readChunk reads up to size bytes from r, and reports whether that was the end of r.
+//
+// carry holds a byte which was read ahead last time, if any.
+func readChunk(r io.Reader, size int, carry *[]byte) ([]byte, bool, error) {
+	buf := make([]byte, size+1)
+	n := copy(buf, *carry)
+	m, err := io.ReadFull(r, buf[n:])
+	n += m
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		*carry = nil
+		return buf[:n], true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	// We managed to read a byte past the end of this chunk so there is more to come.
+	*carry = []byte{buf[size]}
+	return buf[:size], false, nil
+}
+
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	carry   []byte
+	out     bytes.Buffer
+	done    bool
+}
+
+func newEncryptReader(src io.Reader, aead cipher.AEAD, salts []byte) io.Reader {
+	r := &encryptReader{src: src, aead: aead}
+	r.out.WriteString(magic)
+	r.out.Write(salts)
+	return r
+}
+
+// newResumeEncryptReader carries on encrypting a file from the start of chunk counter, without a header.
+func newResumeEncryptReader(src io.Reader, aead cipher.AEAD, counter uint64) io.Reader {
+	return &encryptReader{src: src, aead: aead, counter: counter}
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && !r.done {
+		plain, last, err := readChunk(r.src, chunkSize, &r.carry)
+		if err != nil {
+			return 0, err
+		}
+		r.out.Write(r.aead.Seal(nil, nonce(r.counter, last), plain, nil))
+		r.counter++
+		r.done = last
+	}
+	if r.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.out.Read(p)
+}
+
+type decryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	carry   []byte
+	out     bytes.Buffer
+	done    bool
+	// partial is set when reading back an interrupted transfer, which doesn't have a final chunk.
+	partial bool
+}
+
+// readHeader reads the header of an encrypted file, returning the salts used to derive its key.
+func readHeader(src io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("Unable to read encryption header: %w", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("File isn't encrypted or was encrypted by an unsupported version of gog-backup")
+	}
+	return header[len(magic):], nil
+}
+
+func newDecryptReader(src io.Reader, aead cipher.AEAD) io.Reader {
+	return &decryptReader{src: src, aead: aead}
+}
+
+// newPartialDecryptReader decrypts the whole chunks of an interrupted transfer.
+func newPartialDecryptReader(src io.Reader, aead cipher.AEAD) io.Reader {
+	return &decryptReader{src: src, aead: aead, partial: true}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && !r.done {
+		sealed, last, err := readChunk(r.src, chunkSize+tagSize, &r.carry)
+		if err != nil {
+			return 0, err
+		}
+		plain, err := r.aead.Open(nil, nonce(r.counter, last && !r.partial), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to decrypt, the file is corrupt, truncated or the key is wrong: %w", err)
+		}
+		r.out.Write(plain)
+		r.counter++
+		r.done = last
+	}
+	if r.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.out.Read(p)
+}
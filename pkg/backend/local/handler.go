@@ -0,0 +1,175 @@
+package local
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+var (
+	targetDir = flag.String("local-dir", os.Getenv("HOME")+"/GoG", "The target directory to download to. (backend=local)")
+)
+
+type handler struct {
+	dir string
+}
+
+// NewHandler creates a backend linked to the directory given by -local-dir.
+func NewHandler() backend.Handler {
+	return NewDirHandler(*targetDir)
+}
+
+// NewDirHandler creates a backend linked to a local directory.
+func NewDirHandler(dir string) backend.Handler {
+	return &handler{dir: dir}
+}
+
+func (h *handler) GetPrefix() string {
+	return h.dir
+}
+
+func (h *handler) GetDisplayPrefix() string {
+	return ""
+}
+
+func (h *handler) ReadFile(ctx context.Context, filename string) (string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	return string(contents), err
+}
+
+func (h *handler) WriteFile(ctx context.Context, filename string, content string) error {
+	return ioutil.WriteFile(filename, []byte(content), 0666)
+}
+
+func (h *handler) FileExists(ctx context.Context, filename string) (bool, error) {
+	info, err := os.Stat(filename)
+	return info != nil, err
+}
+
+func (h *handler) OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (h *handler) Stat(ctx context.Context, filename string) (*backend.FileInfo, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &backend.FileInfo{Name: filename, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (h *handler) Delete(ctx context.Context, filename string) error {
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (h *handler) Rename(ctx context.Context, oldname string, newname string) error {
+	err := os.MkdirAll(path.Dir(newname), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldname, newname)
+}
+
+func (h *handler) List(ctx context.Context, prefix string) ([]backend.FileInfo, error) {
+	var files []backend.FileInfo
+	err := filepath.Walk(prefix, func(filename string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if filename == prefix && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, backend.FileInfo{
+				Name:    filepath.ToSlash(filename),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (h *handler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	return h.ResumeFile(ctx, reader, basepath, filename, 0)
+}
+
+func (h *handler) PartialSize(ctx context.Context, basepath string, filename string) (int64, error) {
+	info, err := os.Stat(path.Join(basepath, "."+filename+".tmp"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (h *handler) OpenPartial(ctx context.Context, basepath string, filename string) (io.ReadCloser, error) {
+	return os.Open(path.Join(basepath, "."+filename+".tmp"))
+}
+
+func (h *handler) ResumeFile(ctx context.Context, reader io.Reader, basepath string, filename string, offset int64) error {
+	if filename == "" {
+		return fmt.Errorf("No filename available, skipping this file")
+	}
+
+	err := os.MkdirAll(basepath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is left behind on failure so that the next attempt can pick up where this one left off.
+	tmpfile := path.Join(basepath, "."+filename+".tmp")
+	outfile := path.Join(basepath, filename)
+	writer, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	err = writer.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, backend.NewContextReader(ctx, reader))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpfile, outfile)
+	return err
+}
@@ -0,0 +1,275 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+type handler struct {
+	destinations []backend.Handler
+	lock         sync.Mutex
+	// completed tracks which destinations already have a file from a previous attempt which failed elsewhere.
+	completed map[string]map[int]bool
+}
+
+// NewHandler creates a backend which stores everything in several other backends at once.
+//
+// Each destination keeps its own prefix, so paths given to this backend should be relative.
+func NewHandler(destinations ...backend.Handler) backend.Handler {
+	return &handler{
+		destinations: destinations,
+		completed:    make(map[string]map[int]bool),
+	}
+}
+
+// path converts a path into one for a particular destination.
+func (h *handler) path(destination backend.Handler, p string) string {
+	if prefix := destination.GetPrefix(); prefix != "" {
+		return path.Join(prefix, p)
+	}
+	return p
+}
+
+// Replicas implements backend.Replicator, as every file is stored in each destination which doesn't already have it.
+func (h *handler) Replicas(ctx context.Context, basepath string, filename string, source *backend.GogFile) int {
+	replicas := 0
+	for _, i := range h.targets(ctx, basepath, filename, source) {
+		destination := h.destinations[i]
+		replicas += backend.Replicas(ctx, destination, h.path(destination, basepath), filename, source)
+	}
+	return replicas
+}
+
+func (h *handler) GetPrefix() string {
+	return ""
+}
+
+func (h *handler) GetDisplayPrefix() string {
+	var displays []string
+	for _, destination := range h.destinations {
+		display := destination.GetDisplayPrefix()
+		if display == "" {
+			display = destination.GetPrefix()
+		}
+		displays = append(displays, display)
+	}
+	return "[" + strings.Join(displays, ", ") + "]"
+}
+
+// ReadFile only succeeds if every destination has the same content for a file, so that anything which is out of date
+// in any destination will be updated.
+func (h *handler) ReadFile(ctx context.Context, filename string) (string, error) {
+	var result string
+	for i, destination := range h.destinations {
+		content, err := destination.ReadFile(ctx, h.path(destination, filename))
+		if err != nil {
+			return "", err
+		}
+		if i > 0 && content != result {
+			return "", fmt.Errorf("%s differs between destinations", filename)
+		}
+		result = content
+	}
+	return result, nil
+}
+
+func (h *handler) WriteFile(ctx context.Context, filename string, content string) error {
+	var errs []string
+	for _, destination := range h.destinations {
+		if err := destination.WriteFile(ctx, h.path(destination, filename), content); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %+v", h.name(destination), err))
+		}
+	}
+	return combine(errs)
+}
+
+// FileExists only reports a file as existing if every destination has it.
+func (h *handler) FileExists(ctx context.Context, filename string) (bool, error) {
+	for _, destination := range h.destinations {
+		exists, err := destination.FileExists(ctx, h.path(destination, filename))
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// OpenFile reads from the first destination which has the file.
+func (h *handler) OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	var err error
+	for _, destination := range h.destinations {
+		var reader io.ReadCloser
+		var size int64
+		reader, size, err = destination.OpenFile(ctx, h.path(destination, filename))
+		if err == nil {
+			return reader, size, nil
+		}
+	}
+	return nil, 0, err
+}
+
+// Stat describes the file in the first destination, but like FileExists the file is only found if every destination
+// has it.
+func (h *handler) Stat(ctx context.Context, filename string) (*backend.FileInfo, error) {
+	var result *backend.FileInfo
+	for _, destination := range h.destinations {
+		info, err := destination.Stat(ctx, h.path(destination, filename))
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = info
+			result.Name = filename
+		}
+	}
+	return result, nil
+}
+
+func (h *handler) Delete(ctx context.Context, filename string) error {
+	var errs []string
+	for _, destination := range h.destinations {
+		if err := destination.Delete(ctx, h.path(destination, filename)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %+v", h.name(destination), err))
+		}
+	}
+	return combine(errs)
+}
+
+func (h *handler) Rename(ctx context.Context, oldname string, newname string) error {
+	var errs []string
+	for _, destination := range h.destinations {
+		if err := destination.Rename(ctx, h.path(destination, oldname), h.path(destination, newname)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %+v", h.name(destination), err))
+		}
+	}
+	return combine(errs)
+}
+
+// List lists the files in the first destination.
+func (h *handler) List(ctx context.Context, prefix string) ([]backend.FileInfo, error) {
+	destination := h.destinations[0]
+	files, err := destination.List(ctx, h.path(destination, prefix))
+	if base := destination.GetPrefix(); base != "" {
+		for i := range files {
+			files[i].Name = strings.TrimPrefix(strings.TrimPrefix(files[i].Name, base), "/")
+		}
+	}
+	return files, err
+}
+
+// targets lists the destinations which a transfer still needs to go to. Destinations which already have the current
+// version of the file, or which finished it on an earlier attempt, are left out.
+func (h *handler) targets(ctx context.Context, basepath string, filename string, source *backend.GogFile) []int {
+	h.lock.Lock()
+	completed := h.completed[path.Join(basepath, filename)]
+	h.lock.Unlock()
+
+	var targets []int
+	for i, destination := range h.destinations {
+		if completed[i] {
+			continue
+		}
+		if source != nil && source.Version != "" {
+			versionFile := h.path(destination, path.Join(basepath, "."+filename+".version"))
+			if version, _ := destination.ReadFile(ctx, versionFile); version == source.Version {
+				continue
+			}
+		}
+		targets = append(targets, i)
+	}
+	return targets
+}
+
+// TransferFile sends a single download to every destination at once.
+//
+// The download is spooled to a temporary file so that each destination can read it as fast as it's able to, and it
+// stops being read once every destination has failed. If only some destinations fail then the others still keep their
+// copy, and only the destinations which failed will be tried again on the next attempt.
+func (h *handler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	targets := h.targets(ctx, basepath, filename, source)
+	errs := make([]error, len(targets))
+	var readErr error
+	switch len(targets) {
+	case 0:
+		_, readErr = io.Copy(ioutil.Discard, reader)
+	case 1:
+		destination := h.destinations[targets[0]]
+		errs[0] = destination.TransferFile(ctx, reader, h.path(destination, basepath), filename, source)
+	default:
+		readErr = h.spool(ctx, reader, basepath, filename, source, targets, errs)
+	}
+
+	key := path.Join(basepath, filename)
+	var failures []string
+	h.lock.Lock()
+	completed := h.completed[key]
+	if completed == nil {
+		completed = make(map[int]bool)
+		h.completed[key] = completed
+	}
+	for t, i := range targets {
+		if errs[t] == nil && readErr == nil {
+			completed[i] = true
+		} else if errs[t] != nil {
+			failures = append(failures, fmt.Sprintf("%s: %+v", h.name(h.destinations[i]), errs[t]))
+		}
+	}
+	if readErr == nil && len(failures) == 0 {
+		delete(h.completed, key)
+	}
+	h.lock.Unlock()
+
+	if readErr != nil {
+		return readErr
+	}
+	return combine(failures)
+}
+
+// spool copies reader to several destinations through a temporary file, filling in errs with how each one went.
+func (h *handler) spool(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile, targets []int, errs []error) error {
+	buffer, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer buffer.remove()
+
+	var waitGroup sync.WaitGroup
+	for t, i := range targets {
+		waitGroup.Add(1)
+		go func(t int, destination backend.Handler, reader *spoolReader) {
+			defer waitGroup.Done()
+			defer reader.Close()
+			errs[t] = destination.TransferFile(ctx, reader, h.path(destination, basepath), filename, source)
+		}(t, h.destinations[i], buffer.reader())
+	}
+
+	_, readErr := io.Copy(buffer, reader)
+	if readErr == errNoReaders {
+		// Every destination has already given up, so there's nothing left to read the rest for.
+		readErr = nil
+	}
+	buffer.finish(readErr)
+	waitGroup.Wait()
+	return readErr
+}
+
+func (h *handler) name(destination backend.Handler) string {
+	if display := destination.GetDisplayPrefix(); display != "" {
+		return display
+	}
+	return destination.GetPrefix()
+}
+
+func combine(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Failed for some destinations; %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,196 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/backend/local"
+)
+
+// destination is a local backend in its own directory, which can be made to fail or hold up transfers.
+type destination struct {
+	backend.Handler
+	dir       string
+	transfers int
+	// fail makes transfers stop with an error after reading a little.
+	fail error
+	// wait holds up transfers until it's closed.
+	wait chan struct{}
+	// done is closed once a transfer has finished.
+	done chan struct{}
+}
+
+func newDestination(t *testing.T) *destination {
+	dir, err := ioutil.TempDir("", "gog-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &destination{Handler: local.NewHandler(), dir: dir}
+}
+
+func (d *destination) GetPrefix() string {
+	return d.dir
+}
+
+func (d *destination) GetDisplayPrefix() string {
+	return d.dir
+}
+
+func (d *destination) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	d.transfers++
+	if d.wait != nil {
+		<-d.wait
+	}
+	if d.fail != nil {
+		reader.Read(make([]byte, 1024))
+		return d.fail
+	}
+	err := d.Handler.TransferFile(ctx, reader, basepath, filename, source)
+	if d.done != nil {
+		close(d.done)
+	}
+	return err
+}
+
+func (d *destination) content(t *testing.T, name string) string {
+	content, err := ioutil.ReadFile(path.Join(d.dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// countingReader produces n random bytes and remembers how many were read.
+type countingReader struct {
+	n    int64
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.read >= r.n {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n-r.read {
+		p = p[:r.n-r.read]
+	}
+	n, _ := rand.Read(p)
+	r.read += int64(n)
+	return n, nil
+}
+
+func TestPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	good, bad := newDestination(t), newDestination(t)
+	bad.fail = errors.New("disk full")
+	h := NewHandler(good, bad)
+	source := &backend.GogFile{Version: "1.0"}
+
+	err := h.TransferFile(ctx, strings.NewReader("version 1.0"), "game", "setup.exe", source)
+	if err == nil || !strings.Contains(err.Error(), "disk full") || !strings.Contains(err.Error(), bad.dir) {
+		t.Fatalf("Expected the failure to be reported for %s, got %+v", bad.dir, err)
+	}
+	if content := good.content(t, "game/setup.exe"); content != "version 1.0" {
+		t.Errorf("Expected the working destination to keep its copy, got %q", content)
+	}
+
+	// Only the destination which failed is tried again.
+	bad.fail = nil
+	if replicas := backend.Replicas(ctx, h, "game", "setup.exe", source); replicas != 1 {
+		t.Errorf("Expected 1 replica to be stored on the next attempt, got %d", replicas)
+	}
+	if err := h.TransferFile(ctx, strings.NewReader("version 1.0"), "game", "setup.exe", source); err != nil {
+		t.Fatal(err)
+	}
+	if good.transfers != 1 || bad.transfers != 2 {
+		t.Errorf("Expected 1 and 2 transfers, got %d and %d", good.transfers, bad.transfers)
+	}
+	if content := bad.content(t, "game/setup.exe"); content != "version 1.0" {
+		t.Errorf("Expected the retried destination to have the file, got %q", content)
+	}
+	if replicas := backend.Replicas(ctx, h, "game", "setup.exe", source); replicas != 2 {
+		t.Errorf("Expected every destination to be used once the file is finished, got %d", replicas)
+	}
+}
+
+func TestSkipsUpToDate(t *testing.T) {
+	ctx := context.Background()
+	current, outdated := newDestination(t), newDestination(t)
+	h := NewHandler(current, outdated)
+	source := &backend.GogFile{Version: "2.0"}
+	if err := os.MkdirAll(path.Join(current.dir, "game"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(current.dir, "game/.setup.exe.version"), []byte("2.0"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if replicas := backend.Replicas(ctx, h, "game", "setup.exe", source); replicas != 1 {
+		t.Errorf("Expected only the outdated destination to be counted, got %d", replicas)
+	}
+	if err := h.TransferFile(ctx, strings.NewReader("version 2.0"), "game", "setup.exe", source); err != nil {
+		t.Fatal(err)
+	}
+	if current.transfers != 0 || outdated.transfers != 1 {
+		t.Errorf("Expected only the outdated destination to be transferred to, got %d and %d", current.transfers, outdated.transfers)
+	}
+	if content := outdated.content(t, "game/setup.exe"); content != "version 2.0" {
+		t.Errorf("Expected the outdated destination to be updated, got %q", content)
+	}
+}
+
+func TestStopsWhenEveryDestinationFails(t *testing.T) {
+	first, second := newDestination(t), newDestination(t)
+	first.fail = errors.New("disk full")
+	second.fail = errors.New("permission denied")
+	h := NewHandler(first, second)
+
+	reader := &countingReader{n: 64 << 20}
+	err := h.TransferFile(context.Background(), reader, "game", "setup.exe", nil)
+	if err == nil || !strings.Contains(err.Error(), "disk full") || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("Expected both failures to be reported, got %+v", err)
+	}
+	if reader.read >= reader.n {
+		t.Errorf("Expected the download to stop once every destination failed, but all %d bytes were read", reader.read)
+	}
+}
+
+func TestSlowDestination(t *testing.T) {
+	fast, slow := newDestination(t), newDestination(t)
+	fast.done = make(chan struct{})
+	slow.wait = make(chan struct{})
+	h := NewHandler(fast, slow)
+	content := make([]byte, 4<<20)
+	rand.Read(content)
+
+	result := make(chan error)
+	go func() {
+		result <- h.TransferFile(context.Background(), bytes.NewReader(content), "game", "setup.exe", nil)
+	}()
+
+	// The fast destination shouldn't be held up by the one which hasn't started reading yet.
+	select {
+	case <-fast.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The fast destination was held up by the slow one")
+	}
+	close(slow.wait)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*destination{fast, slow} {
+		if !bytes.Equal([]byte(d.content(t, "game/setup.exe")), content) {
+			t.Errorf("Expected %s to have the whole file", d.dir)
+		}
+	}
+}
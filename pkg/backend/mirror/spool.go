@@ -0,0 +1,120 @@
+package mirror
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// errNoReaders is returned when writing to a spool which nobody is reading any more.
+var errNoReaders = errors.New("every reader has stopped")
+
+// spool keeps everything written to it in a temporary file, so that each of its readers can go at their own pace
+// instead of waiting for the slowest one.
+type spool struct {
+	file    *os.File
+	lock    sync.Mutex
+	changed *sync.Cond
+	size    int64
+	readers int
+	done    bool
+	err     error
+}
+
+func newSpool() (*spool, error) {
+	file, err := ioutil.TempFile("", "gog-backup-mirror-")
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{file: file}
+	s.changed = sync.NewCond(&s.lock)
+	return s, nil
+}
+
+// Write appends to the spool, it fails with errNoReaders once every reader has been closed.
+func (s *spool) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	readers := s.readers
+	s.lock.Unlock()
+	if readers == 0 {
+		return 0, errNoReaders
+	}
+
+	n, err := s.file.Write(p)
+	s.lock.Lock()
+	s.size += int64(n)
+	s.changed.Broadcast()
+	s.lock.Unlock()
+	return n, err
+}
+
+// finish tells the readers that nothing more is coming, they see err once they've read everything if it isn't nil.
+func (s *spool) finish(err error) {
+	s.lock.Lock()
+	s.done = true
+	s.err = err
+	s.changed.Broadcast()
+	s.lock.Unlock()
+}
+
+// remove throws the temporary file away, once every reader is finished with it.
+func (s *spool) remove() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// reader starts a new reader from the beginning of the spool.
+func (s *spool) reader() *spoolReader {
+	s.lock.Lock()
+	s.readers++
+	s.lock.Unlock()
+	return &spoolReader{spool: s}
+}
+
+type spoolReader struct {
+	spool  *spool
+	offset int64
+	closed bool
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.spool
+	s.lock.Lock()
+	for r.offset >= s.size && !s.done {
+		s.changed.Wait()
+	}
+	available := s.size - r.offset
+	done, err := s.done, s.err
+	s.lock.Unlock()
+
+	if available == 0 {
+		if done && err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := s.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Close stops reading, once every reader is closed the spool stops accepting writes.
+func (r *spoolReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	s := r.spool
+	s.lock.Lock()
+	s.readers--
+	s.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,420 @@
+package s3
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/juju/ratelimit"
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+var (
+	bucket     = flag.String("s3-bucket", "", "The bucket to upload to. (backend=s3)")
+	prefix     = flag.String("s3-prefix", "", "A prefix path to upload into a directory. (backend=s3)")
+	endpoint   = flag.String("s3-endpoint", "", "A custom endpoint for S3 compatible services such as MinIO, Backblaze B2 or Wasabi, eg. https://s3.us-west-000.backblazeb2.com (backend=s3)")
+	region     = flag.String("s3-region", "", "The region the bucket is in. (default: detected automatically for AWS, us-east-1 for custom endpoints) (backend=s3)")
+	pathStyle  = flag.Bool("s3-path-style", false, "Use path style addressing (https://endpoint/bucket/key) instead of virtual hosted buckets, which most self-hosted services need. (backend=s3)")
+	caBundle   = flag.String("s3-ca-bundle", "", "A PEM file of certificate authorities to trust when connecting to the endpoint. (backend=s3)")
+	disableSSL = flag.Bool("s3-disable-ssl", false, "Connect to the endpoint over plain HTTP. (backend=s3)")
+
+	storageClass = flag.String("s3-storage-class", "", "The storage class to upload files with, eg. STANDARD_IA, GLACIER_IR or DEEP_ARCHIVE. Version files are always uploaded as STANDARD so that they can be read back. Files in GLACIER or DEEP_ARCHIVE can't be verified or kept with -keep-versions. (default: STANDARD) (backend=s3)")
+	sse          = flag.String("s3-sse", "", "Server-side encryption to apply to uploads; AES256 for SSE-S3 or aws:kms for SSE-KMS. (backend=s3)")
+	sseKMSKeyID  = flag.String("s3-sse-kms-key-id", "", "The KMS key to use for SSE-KMS, if not the default key for S3. (backend=s3)")
+	tags         = flag.Bool("s3-tags", false, "Tag uploaded files with the GoG product ID, platform, language and version for use in lifecycle rules. (backend=s3)")
+)
+
+// storageClasses are the storage classes which may be used for uploads. This is maintained separately to
+// s3.StorageClass_Values() as the SDK doesn't know about some of the newer ones.
+var storageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassReducedRedundancy,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	"GLACIER_IR",
+	s3.StorageClassGlacier,
+	s3.StorageClassDeepArchive,
+	s3.StorageClassOutposts,
+}
+
+// maxCopySize is the largest file which S3 is able to copy in a single request.
+var maxCopySize int64 = 5 * 1024 * 1024 * 1024
+
+// archiveClasses are the storage classes which objects have to be restored from before they can be read.
+var archiveClasses = map[string]bool{
+	s3.StorageClassGlacier:     true,
+	s3.StorageClassDeepArchive: true,
+}
+
+type handler struct {
+	downloader   *s3manager.Downloader
+	uploader     *s3manager.Uploader
+	uploadBucket *ratelimit.Bucket
+	svc          *s3.S3
+}
+
+// NewHandler creates a backend linked to an S3 bucket.
+func NewHandler(uploadBucket *ratelimit.Bucket) (backend.Handler, error) {
+	if *storageClass != "" && !contains(storageClasses, *storageClass) {
+		return nil, fmt.Errorf("Unknown storage class (%s): valid values are; %s", *storageClass, strings.Join(storageClasses, ", "))
+	}
+	if *sse != "" && !contains(s3.ServerSideEncryption_Values(), *sse) {
+		return nil, fmt.Errorf("Unknown server-side encryption (%s): valid values are; %s", *sse, strings.Join(s3.ServerSideEncryption_Values(), ", "))
+	}
+	if *sseKMSKeyID != "" && *sse != s3.ServerSideEncryptionAwsKms {
+		return nil, fmt.Errorf("-s3-sse-kms-key-id requires -s3-sse=%s", s3.ServerSideEncryptionAwsKms)
+	}
+
+	config := aws.NewConfig().
+		WithS3ForcePathStyle(*pathStyle).
+		WithDisableSSL(*disableSSL)
+	if *endpoint != "" {
+		config = config.WithEndpoint(*endpoint)
+	}
+	options := session.Options{Config: *config}
+	if *caBundle != "" {
+		bundle, err := os.Open(*caBundle)
+		if err != nil {
+			return nil, err
+		}
+		defer bundle.Close()
+		options.CustomCABundle = bundle
+	}
+
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketRegion := *region
+	if bucketRegion == "" && *endpoint != "" {
+		// Most S3 compatible services either only have one region or don't care what it's set to.
+		bucketRegion = "us-east-1"
+	}
+	if bucketRegion == "" {
+		bucketRegion, err = s3manager.GetBucketRegion(aws.BackgroundContext(), sess, *bucket, "us-east-1")
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Detected s3://%s in region %s\n", *bucket, bucketRegion)
+	}
+	sess.Config.Region = &bucketRegion
+
+	return &handler{
+		downloader:   s3manager.NewDownloader(sess),
+		uploader:     s3manager.NewUploader(sess),
+		uploadBucket: uploadBucket,
+		svc:          s3.New(sess),
+	}, nil
+}
+
+func (h *handler) GetPrefix() string {
+	return *prefix
+}
+
+// GetDisplayPrefix includes the endpoint for S3 compatible services, as bucket names are only unique within a single
+// service.
+func (h *handler) GetDisplayPrefix() string {
+	if *endpoint == "" {
+		return "s3://" + *bucket
+	}
+	host := *endpoint
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host + u.Path
+	}
+	return "s3://" + strings.TrimSuffix(host, "/") + "/" + *bucket
+}
+
+func (h *handler) ReadFile(ctx context.Context, filename string) (string, error) {
+	buff := aws.NewWriteAtBuffer(make([]byte, 0, 64))
+	_, err := (*h.downloader).DownloadWithContext(ctx, buff, &s3.GetObjectInput{
+		Bucket: aws.String(*bucket),
+		Key:    aws.String(filename),
+	})
+
+	if isNotFound(err) {
+		return "", &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	} else if err != nil {
+		return "", err
+	}
+
+	return string(buff.Bytes()), nil
+}
+
+func (h *handler) WriteFile(ctx context.Context, filename string, content string) error {
+	_, err := (*h.uploader).UploadWithContext(ctx, encrypt(&s3manager.UploadInput{
+		Bucket: aws.String(*bucket),
+		Key:    aws.String(filename),
+		Body:   strings.NewReader(content),
+	}))
+
+	return err
+}
+
+func (h *handler) FileExists(ctx context.Context, filename string) (bool, error) {
+	_, err := h.Stat(ctx, filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *handler) OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	output, err := (*h.svc).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(*bucket),
+		Key:    aws.String(filename),
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+	return output.Body, aws.Int64Value(output.ContentLength), nil
+}
+
+// head fetches everything S3 knows about an object, if the object doesn't exist then the error satisfies
+// os.IsNotExist().
+func (h *handler) head(ctx context.Context, filename string) (*s3.HeadObjectOutput, error) {
+	output, err := (*h.svc).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(*bucket),
+		Key:    aws.String(filename),
+	})
+
+	if isNotFound(err) {
+		return nil, &os.PathError{Op: "stat", Path: filename, Err: os.ErrNotExist}
+	}
+	return output, err
+}
+
+func (h *handler) Stat(ctx context.Context, filename string) (*backend.FileInfo, error) {
+	output, err := h.head(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	return &backend.FileInfo{
+		Name:    filename,
+		Size:    aws.Int64Value(output.ContentLength),
+		ModTime: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+func (h *handler) Delete(ctx context.Context, filename string) error {
+	_, err := (*h.svc).DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(*bucket),
+		Key:    aws.String(filename),
+	})
+
+	return err
+}
+
+// Rename copies a file to its new name and then removes the original, as S3 has no way to move files.
+func (h *handler) Rename(ctx context.Context, oldname string, newname string) error {
+	info, err := h.head(ctx, oldname)
+	if err != nil {
+		return err
+	}
+	// Archived objects can't be copied or downloaded until they've been restored, which can take hours.
+	if class := aws.StringValue(info.StorageClass); archiveClasses[class] && !strings.Contains(aws.StringValue(info.Restore), `ongoing-request="false"`) {
+		return fmt.Errorf("Unable to rename %s as it is stored in %s, it needs to be restored first", oldname, class)
+	}
+
+	if aws.Int64Value(info.ContentLength) <= maxCopySize {
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(*bucket),
+			Key:        aws.String(newname),
+			CopySource: aws.String(copySource(oldname)),
+		}
+		if *storageClass != "" {
+			input.StorageClass = storageClass
+		}
+		if *sse != "" {
+			input.ServerSideEncryption = sse
+		}
+		if *sseKMSKeyID != "" {
+			input.SSEKMSKeyId = sseKMSKeyID
+		}
+		_, err = (*h.svc).CopyObjectWithContext(ctx, input)
+	} else {
+		// Anything larger than this has to be copied through here instead.
+		var output *s3.GetObjectOutput
+		output, err = (*h.svc).GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(*bucket),
+			Key:    aws.String(oldname),
+		})
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+
+		input := encrypt(&s3manager.UploadInput{
+			Bucket:   aws.String(*bucket),
+			Key:      aws.String(newname),
+			Body:     backend.NewContextReader(ctx, output.Body),
+			Metadata: output.Metadata,
+		})
+		if *storageClass != "" {
+			input.StorageClass = storageClass
+		}
+		// CopyObject keeps the tags, but they aren't part of the object when it's downloaded.
+		if aws.Int64Value(output.TagCount) > 0 {
+			var tagging *s3.GetObjectTaggingOutput
+			tagging, err = (*h.svc).GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+				Bucket: aws.String(*bucket),
+				Key:    aws.String(oldname),
+			})
+			if err != nil {
+				return err
+			}
+			values := url.Values{}
+			for _, tag := range tagging.TagSet {
+				values.Set(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+			}
+			input.Tagging = aws.String(values.Encode())
+		}
+		_, err = upload(h.uploader, input)
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.Delete(ctx, oldname)
+}
+
+func (h *handler) List(ctx context.Context, prefix string) ([]backend.FileInfo, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var files []backend.FileInfo
+	err := (*h.svc).ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(*bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			files = append(files, backend.FileInfo{
+				Name:    aws.StringValue(object.Key),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+
+	return files, err
+}
+
+func (h *handler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	key := path.Join(basepath, filename)
+	var Body io.Reader
+	if (*h).uploadBucket == nil {
+		Body = reader
+	} else {
+		Body = ratelimit.Reader(reader, (*h).uploadBucket)
+	}
+	Body = backend.NewContextReader(ctx, Body)
+
+	input := encrypt(&s3manager.UploadInput{
+		Bucket:   aws.String(*bucket),
+		Key:      aws.String(key),
+		Body:     Body,
+		Metadata: metadata(source),
+	})
+	if *storageClass != "" {
+		input.StorageClass = storageClass
+	}
+	if *tags {
+		input.Tagging = aws.String(metadataValues(source).Encode())
+	}
+
+	_, err := upload(h.uploader, input)
+
+	return err
+}
+
+// upload uploads a file which is being streamed in from elsewhere. Uploads are cancelled by the Body failing rather than
+// through a context, as the uploader uses the same context to clean up any parts which were already uploaded and a
+// cancelled context would leave them lying around in the bucket.
+func upload(uploader *s3manager.Uploader, input *s3manager.UploadInput) (*s3manager.UploadOutput, error) {
+	return uploader.UploadWithContext(aws.BackgroundContext(), input)
+}
+
+// encrypt applies the server-side encryption options to an upload.
+func encrypt(input *s3manager.UploadInput) *s3manager.UploadInput {
+	if *sse != "" {
+		input.ServerSideEncryption = sse
+	}
+	if *sseKMSKeyID != "" {
+		input.SSEKMSKeyId = sseKMSKeyID
+	}
+	return input
+}
+
+// metadataValues describes where a file came from.
+func metadataValues(source *backend.GogFile) url.Values {
+	values := url.Values{}
+	if source == nil {
+		return values
+	}
+	values.Set("gog-product-id", strconv.FormatInt(source.ProductID, 10))
+	if source.Platform != "" {
+		values.Set("gog-platform", source.Platform)
+	}
+	if source.Language != "" {
+		values.Set("gog-language", source.Language)
+	}
+	if source.Version != "" {
+		values.Set("gog-version", source.Version)
+	}
+	return values
+}
+
+func metadata(source *backend.GogFile) map[string]*string {
+	result := make(map[string]*string)
+	for key, value := range metadataValues(source) {
+		result[key] = aws.String(value[0])
+	}
+	return result
+}
+
+// copySource builds the URL encoded source for a CopyObject request.
+func copySource(key string) string {
+	parts := strings.Split(*bucket+"/"+key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// isNotFound checks whether err means that the file doesn't exist.
+func isNotFound(err error) bool {
+	// HEAD requests don't have a body for S3 to put an error code in, so all we get is the status code.
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchKey
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,327 @@
+package s3
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+	original := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, original) })
+}
+
+func TestGetDisplayPrefix(t *testing.T) {
+	setFlag(t, "s3-bucket", "backups")
+	h := &handler{}
+	for endpoint, expected := range map[string]string{
+		"":                                       "s3://backups",
+		"https://s3.us-west-000.backblazeb2.com": "s3://s3.us-west-000.backblazeb2.com/backups",
+		"http://127.0.0.1:9000/":                 "s3://127.0.0.1:9000/backups",
+		"minio.local:9000":                       "s3://minio.local:9000/backups",
+	} {
+		setFlag(t, "s3-endpoint", endpoint)
+		if prefix := h.GetDisplayPrefix(); prefix != expected {
+			t.Errorf("%q: expected %s, got %s", endpoint, expected, prefix)
+		}
+	}
+}
+
+// TestMinIO runs against a real S3 compatible service, such as a MinIO server started with:
+//
+//	docker run -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//
+// It is skipped unless GOG_BACKUP_TEST_S3_ENDPOINT and GOG_BACKUP_TEST_S3_BUCKET are set, along with credentials in
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. The bucket must already exist. Set GOG_BACKUP_TEST_S3_CA_BUNDLE as well
+// if the endpoint uses a certificate from a private certificate authority.
+func TestMinIO(t *testing.T) {
+	testEndpoint := os.Getenv("GOG_BACKUP_TEST_S3_ENDPOINT")
+	testBucket := os.Getenv("GOG_BACKUP_TEST_S3_BUCKET")
+	if testEndpoint == "" || testBucket == "" {
+		t.Skip("GOG_BACKUP_TEST_S3_ENDPOINT and GOG_BACKUP_TEST_S3_BUCKET aren't set")
+	}
+	setFlag(t, "s3-endpoint", testEndpoint)
+	setFlag(t, "s3-bucket", testBucket)
+	setFlag(t, "s3-path-style", "true")
+	setFlag(t, "s3-tags", "true")
+	if bundle := os.Getenv("GOG_BACKUP_TEST_S3_CA_BUNDLE"); bundle != "" {
+		setFlag(t, "s3-ca-bundle", bundle)
+	}
+
+	h, err := NewHandler(nil)
+	if err != nil {
+		t.Fatalf("Unable to create handler: %+v", err)
+	}
+	if display := h.GetDisplayPrefix(); !strings.Contains(display, testBucket) || display == "s3://"+testBucket {
+		t.Errorf("Display prefix should include the endpoint, got %s", display)
+	}
+
+	ctx := context.Background()
+	basepath := fmt.Sprintf("gog-backup-test-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		files, _ := h.List(ctx, basepath)
+		for _, file := range files {
+			h.Delete(ctx, file.Name)
+		}
+	})
+	file := path.Join(basepath, "setup.exe")
+
+	if _, err = h.Stat(ctx, file); !os.IsNotExist(err) {
+		t.Errorf("Expected Stat of a missing file to not exist, got %#v", err)
+	}
+	if _, err = h.ReadFile(ctx, file); !os.IsNotExist(err) {
+		t.Errorf("Expected ReadFile of a missing file to not exist, got %#v", err)
+	}
+	if exists, err := h.FileExists(ctx, file); exists || err != nil {
+		t.Errorf("Expected a missing file to not exist, got %v %+v", exists, err)
+	}
+
+	if err = h.TransferFile(ctx, strings.NewReader("hello world"), basepath, "setup.exe", &backend.GogFile{ProductID: 1, Version: "1.0"}); err != nil {
+		t.Fatalf("Unable to upload: %+v", err)
+	}
+	if info, err := h.Stat(ctx, file); err != nil || info.Size != 11 {
+		t.Errorf("Unexpected file after upload: %+v %+v", info, err)
+	}
+
+	versionFile := path.Join(basepath, ".setup.exe.version")
+	if err = h.WriteFile(ctx, versionFile, "1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := h.ReadFile(ctx, versionFile); version != "1.0" || err != nil {
+		t.Errorf("Expected version 1.0, got %q %+v", version, err)
+	}
+
+	archived := path.Join(basepath, ".archive", "setup.exe", "1.0", "setup.exe")
+	if err = h.Rename(ctx, file, archived); err != nil {
+		t.Fatalf("Unable to rename: %+v", err)
+	}
+	if exists, _ := h.FileExists(ctx, file); exists {
+		t.Errorf("Renamed file still exists")
+	}
+	tagging, err := h.(*handler).svc.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(testBucket), Key: aws.String(archived)})
+	if err != nil || len(tagging.TagSet) != 2 {
+		t.Errorf("Expected the tags to be kept when renaming, got %+v %+v", tagging, err)
+	}
+	reader, size, err := h.OpenFile(ctx, archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(contents) != "hello world" || size != 11 {
+		t.Errorf("Unexpected contents after renaming: %q (%d)", contents, size)
+	}
+
+	files, err := h.List(ctx, basepath)
+	if err != nil || len(files) != 2 {
+		t.Errorf("Expected 2 files, got %+v %+v", files, err)
+	}
+}
+
+// object is a file stored by fakeS3, along with the headers it was uploaded with.
+type object struct {
+	body   []byte
+	header http.Header
+}
+
+// fakeS3 is just enough of S3 to check which options are sent with each request.
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]*object
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	key := strings.TrimPrefix(r.URL.Path, "/backups/")
+	existing := s.objects[key]
+	_, tagging := r.URL.Query()["tagging"]
+
+	switch {
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		from := s.objects[strings.TrimPrefix(source, "backups/")]
+		if from == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		header := r.Header.Clone()
+		// Tags are copied along with the object unless they're replaced.
+		if r.Header.Get("X-Amz-Tagging-Directive") != "REPLACE" {
+			header.Set("X-Amz-Tagging", from.header.Get("X-Amz-Tagging"))
+		}
+		s.objects[key] = &object{from.body, header}
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+	case r.Method == "PUT":
+		s.objects[key] = &object{body, r.Header.Clone()}
+		w.Header().Set("ETag", `"etag"`)
+	case existing == nil:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+	case r.Method == "GET" && tagging:
+		tags, _ := url.ParseQuery(existing.header.Get("X-Amz-Tagging"))
+		fmt.Fprint(w, `<Tagging><TagSet>`)
+		for name := range tags {
+			fmt.Fprintf(w, `<Tag><Key>%s</Key><Value>%s</Value></Tag>`, name, tags.Get(name))
+		}
+		fmt.Fprint(w, `</TagSet></Tagging>`)
+	case r.Method == "HEAD" || r.Method == "GET":
+		tags, _ := url.ParseQuery(existing.header.Get("X-Amz-Tagging"))
+		w.Header().Set("Content-Length", fmt.Sprint(len(existing.body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Amz-Tagging-Count", fmt.Sprint(len(tags)))
+		for _, name := range []string{"X-Amz-Storage-Class", "X-Amz-Restore"} {
+			if value := existing.header.Get(name); value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+		if r.Method == "GET" {
+			w.Write(existing.body)
+		}
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeS3) get(key string) *object {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.objects[key]
+}
+
+func newFakeS3Handler(t *testing.T) (*handler, *fakeS3) {
+	fake := &fakeS3{objects: make(map[string]*object)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	for name, value := range map[string]string{"AWS_ACCESS_KEY_ID": "minio", "AWS_SECRET_ACCESS_KEY": "minio123"} {
+		original, set := os.LookupEnv(name)
+		os.Setenv(name, value)
+		t.Cleanup(func() {
+			if set {
+				os.Setenv(name, original)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+	setFlag(t, "s3-endpoint", server.URL)
+	setFlag(t, "s3-bucket", "backups")
+	setFlag(t, "s3-path-style", "true")
+
+	h, err := NewHandler(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*handler), fake
+}
+
+func TestUploadOptions(t *testing.T) {
+	h, fake := newFakeS3Handler(t)
+	setFlag(t, "s3-storage-class", "STANDARD_IA")
+	setFlag(t, "s3-sse", "aws:kms")
+	setFlag(t, "s3-sse-kms-key-id", "my-key")
+	setFlag(t, "s3-tags", "true")
+	ctx := context.Background()
+
+	source := &backend.GogFile{ProductID: 1, Platform: "Windows", Language: "English", Version: "1.0"}
+	if err := h.TransferFile(ctx, strings.NewReader("installer"), "Some Game", "setup.exe", source); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.WriteFile(ctx, "Some Game/.setup.exe.version", "1.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOptions := func(key string, storageClass string) {
+		t.Helper()
+		o := fake.get(key)
+		if o == nil {
+			t.Fatalf("%s wasn't stored", key)
+		}
+		if class := o.header.Get("X-Amz-Storage-Class"); class != storageClass {
+			t.Errorf("%s: expected storage class %q, got %q", key, storageClass, class)
+		}
+		if o.header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" || o.header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "my-key" {
+			t.Errorf("%s: expected SSE-KMS with my-key, got %v", key, o.header)
+		}
+	}
+	expectTags := func(key string) {
+		t.Helper()
+		tags, _ := url.ParseQuery(fake.get(key).header.Get("X-Amz-Tagging"))
+		if tags.Get("gog-product-id") != "1" || tags.Get("gog-platform") != "Windows" || tags.Get("gog-language") != "English" || tags.Get("gog-version") != "1.0" {
+			t.Errorf("%s: unexpected tags %v", key, tags)
+		}
+	}
+
+	expectOptions("Some Game/setup.exe", "STANDARD_IA")
+	expectTags("Some Game/setup.exe")
+	// Version files need to stay readable.
+	expectOptions("Some Game/.setup.exe.version", "")
+
+	if err := h.Rename(ctx, "Some Game/setup.exe", "Some Game/.archive/1.0/setup.exe"); err != nil {
+		t.Fatal(err)
+	}
+	expectOptions("Some Game/.archive/1.0/setup.exe", "STANDARD_IA")
+	expectTags("Some Game/.archive/1.0/setup.exe")
+
+	// Files too large to copy in one go are uploaded again instead, which mustn't lose anything either.
+	original := maxCopySize
+	maxCopySize = 1
+	defer func() { maxCopySize = original }()
+	if err := h.Rename(ctx, "Some Game/.archive/1.0/setup.exe", "Some Game/setup.exe"); err != nil {
+		t.Fatal(err)
+	}
+	expectOptions("Some Game/setup.exe", "STANDARD_IA")
+	expectTags("Some Game/setup.exe")
+	if o := fake.get("Some Game/setup.exe"); string(o.body) != "installer" {
+		t.Errorf("Unexpected contents after renaming: %q", o.body)
+	}
+	if fake.get("Some Game/.archive/1.0/setup.exe") != nil {
+		t.Errorf("The original wasn't removed")
+	}
+}
+
+func TestRenameArchived(t *testing.T) {
+	h, fake := newFakeS3Handler(t)
+	setFlag(t, "s3-storage-class", "DEEP_ARCHIVE")
+	ctx := context.Background()
+	if err := h.TransferFile(ctx, strings.NewReader("installer"), "Some Game", "setup.exe", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	err := h.Rename(ctx, "Some Game/setup.exe", "Some Game/.archive/1.0/setup.exe")
+	if err == nil || !strings.Contains(err.Error(), "DEEP_ARCHIVE") {
+		t.Errorf("Expected renaming an archived object to fail clearly, got %+v", err)
+	}
+	if fake.get("Some Game/setup.exe") == nil {
+		t.Errorf("The original shouldn't be removed when it can't be renamed")
+	}
+
+	// Once it has been restored it can be copied as usual.
+	fake.get("Some Game/setup.exe").header.Set("X-Amz-Restore", `ongoing-request="false", expiry-date="Fri, 23 Dec 2022 00:00:00 GMT"`)
+	if err := h.Rename(ctx, "Some Game/setup.exe", "Some Game/.archive/1.0/setup.exe"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.get("Some Game/.archive/1.0/setup.exe") == nil {
+		t.Errorf("The restored object wasn't renamed")
+	}
+}
@@ -0,0 +1,482 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	host          = flag.String("sftp-host", "", "The host to upload to, optionally with a port. (backend=sftp)")
+	user          = flag.String("sftp-user", os.Getenv("USER"), "The user to log in as. (backend=sftp)")
+	dir           = flag.String("sftp-dir", "", "The directory to upload into. (backend=sftp)")
+	keyFile       = flag.String("sftp-key", "", "A private key to log in with. If not provided then only keys from a running ssh-agent will be used. (backend=sftp)")
+	keyPassphrase = flag.String("sftp-key-passphrase", "", "The passphrase for -sftp-key, if it has one. (backend=sftp)")
+	knownHosts    = flag.String("sftp-known-hosts", os.Getenv("HOME")+"/.ssh/known_hosts", "A known_hosts file used to check the identity of the host. (backend=sftp)")
+)
+
+type handler struct {
+	addr         string
+	config       *ssh.ClientConfig
+	lock         sync.Mutex
+	conn         *connection
+	uploadBucket *ratelimit.Bucket
+}
+
+// connection is a single connection to the server, which is replaced with a new one if it is lost.
+type connection struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	// closed is closed once the connection has been lost.
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewHandler creates a backend linked to a directory on an SFTP server.
+func NewHandler(uploadBucket *ratelimit.Bucket) (backend.Handler, error) {
+	if *host == "" {
+		return nil, fmt.Errorf("No host provided, please provide -sftp-host")
+	}
+	addr := *host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	hostKeyCallback, err := knownhosts.New(*knownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if *keyFile != "" {
+		key, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if *keyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(*keyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("No way to authenticate, please provide -sftp-key or start an ssh-agent")
+	}
+
+	h := &handler{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            *user,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+		uploadBucket: uploadBucket,
+	}
+	if _, err = h.connect(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// connectTimeout is the longest to wait for the server while connecting, if the context isn't cancelled first.
+const connectTimeout = 30 * time.Second
+
+// connect returns the current connection to the server, first connecting again if the last one was lost.
+func (h *handler) connect(ctx context.Context) (*connection, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.conn != nil && !h.conn.isClosed() {
+		return h.conn, nil
+	} else if h.conn != nil {
+		log.Printf("Lost connection to sftp://%s@%s, reconnecting.\n", h.config.User, h.addr)
+	}
+
+	conn, err := h.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Connected to sftp://%s@%s\n", h.config.User, h.addr)
+
+	h.conn = conn
+	go func(c *connection) {
+		c.client.Wait()
+		c.close()
+	}(h.conn)
+	return h.conn, nil
+}
+
+// dial connects and logs in to the server. The ssh package doesn't take a context, so the connection is closed to
+// interrupt a handshake which is still waiting on the server when ctx is cancelled.
+func (h *handler) dial(ctx context.Context) (*connection, error) {
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Now().Add(connectTimeout))
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-done:
+		}
+	}()
+	var conn *ssh.Client
+	var client *sftp.Client
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, h.addr, h.config)
+	if err == nil {
+		conn = ssh.NewClient(sshConn, chans, reqs)
+		client, err = sftp.NewClient(conn)
+	}
+	close(done)
+	<-stopped
+
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	return &connection{ssh: conn, client: client, closed: make(chan struct{})}, nil
+}
+
+// do runs fn against the server. If the connection is lost along the way then fn is given one more try once the
+// connection has been re-established, so fn must be safe to repeat.
+func (h *handler) do(ctx context.Context, fn func(client *sftp.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		conn, err := h.connect(ctx)
+		if err != nil {
+			return err
+		}
+		stop := conn.watch(ctx)
+		err = fn(conn.client)
+		stop()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || attempt > 0 || !conn.lost(err) {
+			return err
+		}
+	}
+}
+
+// watch drops the connection if ctx is cancelled before stop is called. The SFTP client has no way to cancel a single
+// request, so this is the only way to interrupt one which is stuck waiting for the server. Anything else using the
+// connection at the time fails too, and the next request reconnects.
+func (c *connection) watch(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// lost checks whether err was caused by the connection going away, in which case the connection is closed so that
+// the next request will reconnect.
+func (c *connection) lost(err error) bool {
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) {
+		c.close()
+	}
+	return c.isClosed()
+}
+
+func (c *connection) close() {
+	c.once.Do(func() {
+		c.ssh.Close()
+		close(c.closed)
+	})
+}
+
+func (c *connection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *handler) GetPrefix() string {
+	return *dir
+}
+
+func (h *handler) GetDisplayPrefix() string {
+	return "sftp://" + *user + "@" + *host
+}
+
+func (h *handler) ReadFile(ctx context.Context, filename string) (string, error) {
+	var contents []byte
+	err := h.do(ctx, func(client *sftp.Client) error {
+		file, err := client.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		contents, err = ioutil.ReadAll(file)
+		return err
+	})
+	return string(contents), err
+}
+
+func (h *handler) WriteFile(ctx context.Context, filename string, content string) error {
+	tmpfile := path.Join(path.Dir(filename), "."+path.Base(filename)+".tmp")
+	return h.do(ctx, func(client *sftp.Client) error {
+		file, err := client.Create(tmpfile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = file.Write([]byte(content))
+		if err != nil {
+			return err
+		}
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+
+		return rename(client, tmpfile, filename)
+	})
+}
+
+func (h *handler) FileExists(ctx context.Context, filename string) (bool, error) {
+	_, err := h.Stat(ctx, filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *handler) OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	var file *sftp.File
+	var info os.FileInfo
+	err := h.do(ctx, func(client *sftp.Client) error {
+		var err error
+		if file, err = client.Open(filename); err != nil {
+			return err
+		}
+		if info, err = file.Stat(); err != nil {
+			file.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (h *handler) Stat(ctx context.Context, filename string) (*backend.FileInfo, error) {
+	var info os.FileInfo
+	err := h.do(ctx, func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(filename)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &backend.FileInfo{Name: filename, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (h *handler) Delete(ctx context.Context, filename string) error {
+	err := h.do(ctx, func(client *sftp.Client) error {
+		return client.Remove(filename)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (h *handler) Rename(ctx context.Context, oldname string, newname string) error {
+	return h.do(ctx, func(client *sftp.Client) error {
+		err := client.MkdirAll(path.Dir(newname))
+		if err != nil {
+			return err
+		}
+		return rename(client, oldname, newname)
+	})
+}
+
+func (h *handler) List(ctx context.Context, prefix string) ([]backend.FileInfo, error) {
+	var files []backend.FileInfo
+	err := h.do(ctx, func(client *sftp.Client) error {
+		files = nil
+		walker := client.Walk(prefix)
+		for walker.Step() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := walker.Err(); err != nil {
+				if walker.Path() == prefix && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info := walker.Stat(); !info.IsDir() {
+				files = append(files, backend.FileInfo{
+					Name:    walker.Path(),
+					Size:    info.Size(),
+					ModTime: info.ModTime(),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (h *handler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	return h.ResumeFile(ctx, reader, basepath, filename, 0)
+}
+
+func (h *handler) PartialSize(ctx context.Context, basepath string, filename string) (int64, error) {
+	info, err := h.Stat(ctx, path.Join(basepath, "."+filename+".tmp"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (h *handler) OpenPartial(ctx context.Context, basepath string, filename string) (io.ReadCloser, error) {
+	file, _, err := h.OpenFile(ctx, path.Join(basepath, "."+filename+".tmp"))
+	return file, err
+}
+
+func (h *handler) ResumeFile(ctx context.Context, reader io.Reader, basepath string, filename string, offset int64) error {
+	if filename == "" {
+		return fmt.Errorf("No filename available, skipping this file")
+	}
+
+	// The reader can't be rewound, so this can't be retried on a new connection. If the connection is lost part way
+	// through then the next attempt will reconnect and resume from wherever this one got to.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn, err := h.connect(ctx)
+	if err != nil {
+		return err
+	}
+	stop := conn.watch(ctx)
+	err = h.resumeFile(ctx, conn.client, reader, basepath, filename, offset)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		conn.lost(err)
+	}
+	return err
+}
+
+func (h *handler) resumeFile(ctx context.Context, client *sftp.Client, reader io.Reader, basepath string, filename string, offset int64) error {
+	err := client.MkdirAll(basepath)
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is left behind on failure so that the next attempt can pick up where this one left off.
+	tmpfile := path.Join(basepath, "."+filename+".tmp")
+	outfile := path.Join(basepath, filename)
+	writer, err := client.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	err = writer.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if h.uploadBucket != nil {
+		reader = ratelimit.Reader(reader, h.uploadBucket)
+	}
+	_, err = io.Copy(writer, backend.NewContextReader(ctx, reader))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return rename(client, tmpfile, outfile)
+}
+
+// rename replaces newpath with oldpath as atomically as the server allows.
+func rename(client *sftp.Client, oldpath string, newpath string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldpath, newpath)
+	}
+
+	// Without the posix-rename extension a plain rename will fail if the file already exists.
+	if err := client.Remove(newpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.Rename(oldpath, newpath)
+}
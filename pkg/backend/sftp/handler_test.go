@@ -0,0 +1,328 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is an SSH server which only speaks SFTP, serving the local filesystem.
+type testServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func startServer(t *testing.T, clientKey ssh.PublicKey) (*testServer, ssh.PublicKey) {
+	hostKey, err := ssh.NewSignerFromKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "gog" && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.conns = append(server.conns, conn)
+			server.lock.Unlock()
+			go server.serve(conn, config)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		server.disconnect()
+	})
+	return server, hostKey.PublicKey()
+}
+
+func (s *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range requests {
+				ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+// disconnect drops every connection to the server, as if the network had gone away.
+func (s *testServer) disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestHandler(t *testing.T) (*handler, *testServer, string) {
+	dir, err := ioutil.TempDir("", "gog-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key := newKey(t)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, hostKey := startServer(t, signer.PublicKey())
+	addr := server.listener.Addr().String()
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err = ioutil.WriteFile(knownHostsPath, []byte(knownhosts.Line([]string{addr}, hostKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "backup")
+	if err = os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("SSH_AUTH_SOCK")
+	setFlag(t, "sftp-host", addr)
+	setFlag(t, "sftp-user", "gog")
+	setFlag(t, "sftp-dir", root)
+	setFlag(t, "sftp-key", keyPath)
+	setFlag(t, "sftp-known-hosts", knownHostsPath)
+
+	h, err := NewHandler(nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %+v", err)
+	}
+	return h.(*handler), server, root
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	h, _, root := newTestHandler(t)
+	basepath := filepath.Join(root, "Some Game", "Windows")
+
+	if _, err := h.Stat(ctx, filepath.Join(basepath, "setup.exe")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file to not exist, got %#v", err)
+	}
+	if exists, err := h.FileExists(ctx, filepath.Join(basepath, "setup.exe")); exists || err != nil {
+		t.Errorf("Expected a missing file to not exist, got %v %+v", exists, err)
+	}
+
+	// An interrupted transfer is left behind to be resumed.
+	failing := io.MultiReader(strings.NewReader("hello "), &errorReader{io.ErrUnexpectedEOF})
+	if err := h.TransferFile(ctx, failing, basepath, "setup.exe", nil); err == nil {
+		t.Fatal("Expected the transfer to fail")
+	}
+	if partial, err := h.PartialSize(ctx, basepath, "setup.exe"); partial != 6 || err != nil {
+		t.Fatalf("Expected a 6 byte partial download, got %d %+v", partial, err)
+	}
+	if err := h.ResumeFile(ctx, strings.NewReader("world"), basepath, "setup.exe", 6); err != nil {
+		t.Fatalf("Unable to resume: %+v", err)
+	}
+
+	file, size, err := h.OpenFile(ctx, filepath.Join(basepath, "setup.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadAll(file)
+	file.Close()
+	if string(contents) != "hello world" || size != 11 {
+		t.Errorf("Unexpected contents after resuming: %q (%d)", contents, size)
+	}
+
+	versionFile := filepath.Join(basepath, ".setup.exe.version")
+	if err = h.WriteFile(ctx, versionFile, "1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.WriteFile(ctx, versionFile, "1.1"); err != nil {
+		t.Fatalf("Unable to replace a file: %+v", err)
+	}
+	if version, err := h.ReadFile(ctx, versionFile); version != "1.1" || err != nil {
+		t.Errorf("Expected version 1.1, got %q %+v", version, err)
+	}
+
+	files, err := h.List(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		if !backend.IsPartial(file.Name) {
+			names = append(names, filepath.Base(file.Name))
+		}
+	}
+	if strings.Join(names, ",") != ".setup.exe.version,setup.exe" {
+		t.Errorf("Unexpected files: %v", names)
+	}
+}
+
+func TestHandlerReconnects(t *testing.T) {
+	ctx := context.Background()
+	h, server, root := newTestHandler(t)
+	filename := filepath.Join(root, "version")
+	if err := h.WriteFile(ctx, filename, "1.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.disconnect()
+	if version, err := h.ReadFile(ctx, filename); version != "1.0" || err != nil {
+		t.Fatalf("Expected to reconnect and read version 1.0, got %q %+v", version, err)
+	}
+
+	// Transfers can't be repeated, but the next one after the connection is lost should still work.
+	server.disconnect()
+	h.TransferFile(ctx, strings.NewReader("first"), root, "setup.exe", nil)
+	if err := h.TransferFile(ctx, strings.NewReader("second"), root, "setup.exe", nil); err != nil {
+		t.Fatalf("Expected to reconnect for the next transfer, got %+v", err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(root, "setup.exe")); string(contents) != "second" || err != nil {
+		t.Errorf("Unexpected contents: %q %+v", contents, err)
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestHandlerCancelled(t *testing.T) {
+	h, _, root := newTestHandler(t)
+	filename := filepath.Join(root, "version")
+	if err := h.WriteFile(context.Background(), filename, "1.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.ReadFile(ctx, filename); err != context.Canceled {
+		t.Errorf("Expected reading to be cancelled, got %+v", err)
+	}
+	if err := h.TransferFile(ctx, strings.NewReader("hello"), root, "setup.exe", nil); err != context.Canceled {
+		t.Errorf("Expected the transfer to be cancelled, got %+v", err)
+	}
+
+	// A transfer which is stuck waiting is interrupted too.
+	ctx, cancel = context.WithCancel(context.Background())
+	stuck, unstick := io.Pipe()
+	defer unstick.Close()
+	go func() {
+		unstick.Write([]byte("hello "))
+		cancel()
+	}()
+	if err := h.TransferFile(ctx, stuck, root, "setup.exe", nil); err != context.Canceled {
+		t.Errorf("Expected the transfer to be cancelled, got %+v", err)
+	}
+
+	if version, err := h.ReadFile(context.Background(), filename); version != "1.0" || err != nil {
+		t.Errorf("Expected to carry on after being cancelled, got %q %+v", version, err)
+	}
+}
+
+func TestConnectCancelled(t *testing.T) {
+	// This server accepts connections but never says anything, like one which has hung.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	h := &handler{addr: listener.Addr().String(), config: &ssh.ClientConfig{User: "gog", HostKeyCallback: ssh.InsecureIgnoreHostKey()}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := h.ReadFile(ctx, "version"); err != context.DeadlineExceeded {
+		t.Errorf("Expected connecting to be cancelled, got %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Connecting wasn't interrupted, it took %s", elapsed)
+	}
+}
@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// GogFile is a struct used to store details about a single download that needs to be processed. This is the data format used over the
+// internal channels.
+type GogFile struct {
+	// ProductID is the ID of the game or movie which this file belongs to. For DLC this is the ID of the base game.
+	ProductID int64
+	// Game is the title of the game or movie which this file belongs to.
+	Game      string
+	PlainName string
+	Platform  string
+	Language  string
+	URL       string
+	File      string
+	Version   string
+	// Size is how big GoG says the file is, eg. "1.2 GB".
+	Size string
+}
+
+// FileInfo describes a single file stored by a Handler.
+type FileInfo struct {
+	// Name is the full path to the file, in the same form that would be passed to other Handler methods.
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Handler is the definition of the interface between the frontend and backend for processing GogFiles.
+//
+// Cancelling the context passed to any method aborts it, and a cancelled transfer never leaves a partially written file
+// in place of the file being transferred.
+type Handler interface {
+	GetPrefix() string
+	GetDisplayPrefix() string
+	ReadFile(ctx context.Context, filename string) (string, error)
+	WriteFile(ctx context.Context, filename string, content string) error
+	FileExists(ctx context.Context, filename string) (bool, error)
+	OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error)
+	// Stat describes a single file, if the file doesn't exist then the error satisfies os.IsNotExist().
+	Stat(ctx context.Context, filename string) (*FileInfo, error)
+	// Delete removes a file, it isn't an error if the file doesn't exist.
+	Delete(ctx context.Context, filename string) error
+	// Rename moves a file, replacing anything which was already at newname.
+	Rename(ctx context.Context, oldname string, newname string) error
+	// List returns every file stored under a directory, including those in subdirectories.
+	List(ctx context.Context, prefix string) ([]FileInfo, error)
+	// TransferFile stores a file, source describes where it came from for backends which are able to keep that
+	// information alongside the file.
+	TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *GogFile) error
+}
+
+// Resumer is an optional interface for Handlers which are able to continue a transfer that was previously interrupted.
+type Resumer interface {
+	// PartialSize returns how many bytes of an interrupted transfer are available to continue from.
+	PartialSize(ctx context.Context, basepath string, filename string) (int64, error)
+	// OpenPartial reads back the content of an interrupted transfer.
+	OpenPartial(ctx context.Context, basepath string, filename string) (io.ReadCloser, error)
+	// ResumeFile continues a transfer by appending reader to the first offset bytes of the interrupted transfer.
+	ResumeFile(ctx context.Context, reader io.Reader, basepath string, filename string, offset int64) error
+}
+
+// Replicator is an optional interface for Handlers which store more than one copy of every file.
+type Replicator interface {
+	// Replicas is how many copies TransferFile would store given the same arguments, which leaves out any copies that
+	// are already up to date.
+	Replicas(ctx context.Context, basepath string, filename string, source *GogFile) int
+}
+
+// Replicas is how many copies of a file a Handler stores when it's transferred.
+func Replicas(ctx context.Context, h Handler, basepath string, filename string, source *GogFile) int {
+	if replicator, ok := h.(Replicator); ok {
+		return replicator.Replicas(ctx, basepath, filename, source)
+	}
+	return 1
+}
+
+// PartialPath is where a Resumer keeps an interrupted transfer of basepath/filename.
+func PartialPath(basepath string, filename string) string {
+	return path.Join(basepath, "."+filename+".tmp")
+}
+
+// IsPartial checks whether a file is an unfinished download rather than part of the backup.
+func IsPartial(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".tmp")
+}
+
+// IsVersionMarker checks whether a file is the version file stored alongside a download.
+func IsVersionMarker(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".version")
+}
+
+// NewContextReader wraps a reader so that it fails as soon as ctx is cancelled, for Handlers which have no other way
+// to interrupt a transfer.
+func NewContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return &contextReader{ctx, reader}
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+)
+
+// archiving checks whether previous versions of files should be kept.
+func (e *Engine) archiving() bool {
+	return e.options.KeepVersions > 0 || e.options.KeepVersionsAge > 0
+}
+
+// archiveDir is where previous versions of a download are kept. It's named after the download rather than the file
+// as GoG sometimes renames files in an update.
+func archiveDir(basepath string, d *File) string {
+	return path.Join(basepath, ".archive", path.Base(d.URL))
+}
+
+// archiveFile moves a previous version of a download out of the way, returning where it was moved to. Nothing is
+// returned if the file doesn't exist.
+//
+// Each version is kept in basepath/.archive/<download>/<version>/ along with a version file recording when it was
+// archived, which is written by finishArchive once the new version has been backed up.
+func (e *Engine) archiveFile(ctx context.Context, basepath string, d *File, file string, version string) (string, error) {
+	handler := e.options.Handler
+	if exists, _ := handler.FileExists(ctx, file); !exists {
+		return "", nil
+	}
+
+	archived := path.Join(archiveDir(basepath, d), safePath(version), path.Base(file))
+	if err := handler.Rename(ctx, file, archived); err != nil {
+		return "", err
+	}
+	return archived, nil
+}
+
+// finishArchive records when a previous version was archived, then removes any versions which are no longer needed.
+func (e *Engine) finishArchive(ctx context.Context, basepath string, d *File, archived string, version string) error {
+	marker := path.Join(path.Dir(archived), "."+path.Base(archived)+".version")
+	if err := e.options.Handler.WriteFile(ctx, marker, version); err != nil {
+		return err
+	}
+	return e.expireVersions(ctx, basepath, d)
+}
+
+// expireVersions removes previous versions of a file which are beyond KeepVersions or KeepVersionsAge.
+func (e *Engine) expireVersions(ctx context.Context, basepath string, d *File) error {
+	handler := e.options.Handler
+	files, err := handler.List(ctx, archiveDir(basepath, d))
+	if err != nil {
+		return err
+	}
+
+	// Versions are aged from when they were archived, which is when their version file was written.
+	archived := make(map[string]time.Time)
+	for _, file := range files {
+		dir := path.Dir(file.Name)
+		if backend.IsVersionMarker(file.Name) || archived[dir].IsZero() {
+			archived[dir] = file.ModTime
+		}
+	}
+	var versions []string
+	for dir := range archived {
+		versions = append(versions, dir)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return archived[versions[i]].After(archived[versions[j]])
+	})
+
+	var errs []string
+	for i, dir := range versions {
+		if (e.options.KeepVersions == 0 || i < e.options.KeepVersions) && (e.options.KeepVersionsAge == 0 || time.Since(archived[dir]) < e.options.KeepVersionsAge) {
+			continue
+		}
+		for _, file := range files {
+			if path.Dir(file.Name) != dir {
+				continue
+			}
+			if err = handler.Delete(ctx, file.Name); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %+v", file.Name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Unable to remove old versions; %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,568 @@
+// Package backup backs up a GoG.com library to a backend.
+//
+// The command line tool is a thin wrapper around an Engine, everything it does during a run can be done by embedding an
+// Engine in other tools instead.
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/mscharley/gog-backup/internal/gog-backup/index"
+	"github.com/mscharley/gog-backup/internal/gog-backup/report"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+// Handler is where a backup is stored.
+type Handler = backend.Handler
+
+// File is a single download from GoG.
+type File = backend.GogFile
+
+// Report summarises the outcome of a run.
+type Report = report.Report
+
+// Entry is a single file which has been backed up, as kept in an Index.
+type Entry = index.Entry
+
+// Index keeps track of what has been backed up already, so that it isn't downloaded again. Files are identified by
+// index.Location().
+type Index interface {
+	Lookup(location string) *Entry
+	// LookupSource finds the latest file downloaded from a GoG URL into a backend, whatever it was called. backend is
+	// index.Location(handler, "").
+	LookupSource(backend string, source string) *Entry
+	Record(entry *Entry) error
+	Forget(location string) error
+}
+
+// Filter decides which parts of the library are backed up.
+type Filter interface {
+	Product(id int64, title string) bool
+	Platform(platform string) bool
+	Languages(available []*gog.GameLanguages) []*gog.GameLanguages
+	Extra(extraType string) bool
+}
+
+// Metrics is told about everything that is transferred during a run.
+type Metrics interface {
+	// Downloaded counts bytes downloaded from GoG.
+	Downloaded(bytes int64)
+	// Uploaded counts bytes sent to the backend, including every copy for backends which store more than one.
+	Uploaded(bytes int64)
+	// Retried counts downloads which are being tried again after failing.
+	Retried()
+}
+
+// LogLevel is who a log message is for.
+type LogLevel int8
+
+const (
+	// Info messages should be shown to the user.
+	Info LogLevel = iota + 1
+	// Debug messages are only useful for working out what went wrong.
+	Debug
+)
+
+// Options configures an Engine. Client and Handler are required, everything else is optional.
+type Options struct {
+	Client  *gog.Client
+	Handler Handler
+	// Filter defaults to backing up everything.
+	Filter Filter
+	// Index defaults to not keeping one, in which case only version files in the backend are used to find out what is
+	// already backed up.
+	Index Index
+	// Metrics defaults to not keeping any.
+	Metrics Metrics
+
+	// Movies backs up movies as well as games, into a separate Movies folder.
+	Movies bool
+	// GameDownloads and ExtraDownloads are how many of each to download concurrently, at least one of each.
+	GameDownloads  int
+	ExtraDownloads int
+	// Retries is how many times to try each download, and each request for the library, before giving up, at least once.
+	Retries int
+	// RetryDelay is how long to wait before the first retry. The wait doubles after every attempt up to RetryMaxDelay,
+	// or up to 1024 times RetryDelay if that is zero, unless GoG asks us to wait longer.
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+	// Checksums verifies downloads against the MD5 checksums published by GoG where available.
+	Checksums bool
+	// DryRun goes through the whole library without actually backing anything up.
+	DryRun bool
+	// DownloadBucket limits how quickly files are downloaded from GoG.
+	DownloadBucket *ratelimit.Bucket
+	// KeepVersions and KeepVersionsAge keep previous versions of files in a .archive folder alongside them when GoG
+	// releases an update, either by number or by how long ago they were replaced.
+	KeepVersions    int
+	KeepVersionsAge time.Duration
+
+	// OnLog is called with messages about what the Engine is doing. By default they're all sent to the log package.
+	// Messages from Client are passed on as Debug messages as well, unless it already has its own OnLog.
+	OnLog func(level LogLevel, message string)
+	// OnProgress is called as the run works its way through the library.
+	OnProgress func(event *Progress)
+	// OnResult is called once for every file as soon as it has been dealt with.
+	OnResult func(result *Result)
+}
+
+// Engine runs backups. An Engine may be used for any number of runs, but only one at a time.
+type Engine struct {
+	options Options
+}
+
+// New creates an Engine.
+func New(options Options) (*Engine, error) {
+	if options.Client == nil {
+		return nil, fmt.Errorf("A GoG client is required")
+	}
+	if options.Handler == nil {
+		return nil, fmt.Errorf("A backend handler is required")
+	}
+	if options.Filter == nil {
+		options.Filter = everything{}
+	}
+	if options.Index == nil {
+		options.Index = noIndex{}
+	}
+	if options.Metrics == nil {
+		options.Metrics = noMetrics{}
+	}
+	if options.GameDownloads < 1 {
+		options.GameDownloads = 1
+	}
+	if options.ExtraDownloads < 1 {
+		options.ExtraDownloads = 1
+	}
+	if options.Retries < 1 {
+		options.Retries = 1
+	}
+	e := &Engine{options}
+	if options.OnLog != nil && options.Client.OnLog == nil {
+		options.Client.OnLog = func(message string) {
+			e.log(Debug, message)
+		}
+	}
+	return e, nil
+}
+
+// Backup downloads everything in the library which isn't backed up already.
+//
+// Once finished is cancelled no more games are fetched from the library and files which are already queued are
+// finished off. Once ctx is cancelled anything still in progress is abandoned. The same context may be passed for both.
+func (e *Engine) Backup(ctx context.Context, finished context.Context) *Report {
+	return e.run(ctx, finished, func(r *run, d *File, basepath string) bool {
+		return r.download(ctx, d, basepath)
+	})
+}
+
+// Each calls fn for every file in the library which would be backed up, without backing anything up. fn is called
+// concurrently, with the folder in the backend that the file belongs in.
+//
+// finished and ctx work the same way as they do for Backup.
+func (e *Engine) Each(ctx context.Context, finished context.Context, fn func(ctx context.Context, d *File, basepath string)) *Report {
+	return e.run(ctx, finished, func(r *run, d *File, basepath string) bool {
+		fn(ctx, d, basepath)
+		return true
+	})
+}
+
+// run keeps track of a single run.
+type run struct {
+	*Engine
+	report     *Report
+	lock       sync.Mutex
+	filesDone  int64
+	filesTotal int64
+}
+
+func (e *Engine) run(ctx context.Context, finished context.Context, process func(r *run, d *File, basepath string) bool) *Report {
+	r := &run{Engine: e, report: report.New()}
+
+	games := make(chan product)
+	gameDownload := make(chan *File, 500)
+	extraDownload := make(chan *File, 500)
+	go r.generateGames(ctx, finished, games)
+	go r.fetchDetails(ctx, games, gameDownload, extraDownload)
+
+	var waitGroup sync.WaitGroup
+	worker := func(downloads <-chan *File) {
+		defer waitGroup.Done()
+		for d := range downloads {
+			basepath := e.basepath(d)
+			// Once the run has been cancelled the rest of the queue is drained without touching it.
+			if ctx.Err() != nil {
+				r.skipped(d, e.filePath(d, basepath, ""), "cancelled")
+				continue
+			}
+			if process(r, d, basepath) {
+				r.fileProcessed()
+			}
+		}
+	}
+
+	waitGroup.Add(e.options.GameDownloads + e.options.ExtraDownloads)
+	for i := 0; i < e.options.GameDownloads; i++ {
+		go worker(gameDownload)
+	}
+	for i := 0; i < e.options.ExtraDownloads; i++ {
+		go worker(extraDownload)
+	}
+
+	r.debugf("Waiting for threads to complete.")
+	waitGroup.Wait()
+	if finished.Err() != nil {
+		r.report.RunError(fmt.Errorf("The run was cancelled before your whole library was processed"))
+	}
+	return r.report
+}
+
+// basepath is the folder in the backend that a file belongs in.
+func (e *Engine) basepath(d *File) string {
+	if prefix := e.options.Handler.GetPrefix(); prefix != "" {
+		return path.Join(prefix, d.File)
+	}
+	return d.File
+}
+
+// filePath is where a file is stored in the backend. If GoG hasn't told us what it's called yet then it's looked up in
+// the index by where it was downloaded from, and failing that it's the folder the file would have been stored in.
+func (e *Engine) filePath(d *File, basepath string, filename string) string {
+	if filename != "" {
+		return path.Join(basepath, filename)
+	}
+	if entry := e.options.Index.LookupSource(index.Location(e.options.Handler, ""), d.URL); entry != nil {
+		return entry.File
+	}
+	return basepath
+}
+
+// product is a single game or movie from the user's library which needs to be processed.
+type product struct {
+	ID        int64
+	MediaType gog.MediaType
+}
+
+func (r *run) generateGames(ctx context.Context, finished context.Context, games chan<- product) {
+	defer close(games)
+
+	mediaTypes := []gog.MediaType{gog.GameMediaType}
+	if r.options.Movies {
+		mediaTypes = append(mediaTypes, gog.MovieMediaType)
+	}
+
+	totalProducts := 0
+	processed := 0
+	for _, mediaType := range mediaTypes {
+		page := 0
+		totalPages := 1
+		for page < totalPages {
+			page++
+			if page == 1 {
+				r.debugf("Fetching page %d (media type %d)", page, mediaType)
+			} else {
+				r.debugf("Fetching page %d/%d (media type %d)", page, totalPages, mediaType)
+			}
+			var result *gog.FilteredProductPage
+			err := r.retry(ctx, fmt.Sprintf("page %d of your library", page), func() (err error) {
+				result, err = r.options.Client.GetFilteredProducts(ctx, mediaType, page)
+				return err
+			})
+			if err != nil {
+				r.debugf("error: %+v", err)
+				r.report.RunError(fmt.Errorf("Unable to fetch page %d of your library: %w", page, err))
+				return
+			}
+
+			if page == 1 {
+				totalProducts += result.TotalProducts
+			}
+			r.progress(&Progress{Type: GamesProgress, Current: int64(processed), Total: int64(totalProducts)})
+			totalPages = result.TotalPages
+			for _, p := range result.Products {
+				if !r.options.Filter.Product(p.ID, p.Title) {
+					r.debugf("Skipping %s (%d) as it has been filtered out", p.Title, p.ID)
+					processed++
+					r.progress(&Progress{Type: GamesProgress, Current: int64(processed), Total: int64(totalProducts)})
+					continue
+				}
+				select {
+				case games <- product{p.ID, mediaType}:
+					processed++
+					r.progress(&Progress{Type: GamesProgress, Current: int64(processed), Total: int64(totalProducts)})
+				case <-finished.Done():
+					r.progress(&Progress{Type: GamesProgress, Current: int64(processed), Total: int64(totalProducts), Final: true})
+					return
+				}
+			}
+		}
+	}
+}
+
+// SafePath makes a title or version safe to use as a folder name.
+func safePath(path string) string {
+	return strings.Replace(
+		strings.Replace(strings.TrimSpace(path), "/", "", -1),
+		":", " -", -1)
+}
+
+// languageDownload is a download along with the language it belongs to and the folder it should be stored in.
+type languageDownload struct {
+	*gog.GameDownload
+	Language string
+	Folder   string
+	// Selected is set if the download belongs to any of the languages which are being backed up.
+	Selected bool
+}
+
+// dedupeLanguages collects the downloads for every available language, removing any downloads which are shared between
+// languages and marking the ones which belong to a selected language.
+//
+// Where a download is stored depends on everything GoG ships rather than on what has been selected, so that changing
+// the language filters never moves anything around. When downloads are available in more than one language then each
+// language gets its own folder, except for shared downloads which don't belong to any language in particular.
+// Downloads which are only available in a single language stay where they are.
+func dedupeLanguages(available []*gog.GameLanguages, selected []*gog.GameLanguages, downloads func(*gog.GameLanguages) []*gog.GameDownload) []languageDownload {
+	shipped := 0
+	for _, language := range available {
+		if len(downloads(language)) > 0 {
+			shipped++
+		}
+	}
+	isSelected := make(map[*gog.GameLanguages]bool)
+	for _, language := range selected {
+		isSelected[language] = true
+	}
+
+	var result []languageDownload
+	seen := make(map[string]int)
+	for _, language := range available {
+		for _, d := range downloads(language) {
+			if i, ok := seen[d.ManualDownloadURL]; ok {
+				result[i].Language = ""
+				result[i].Folder = ""
+				result[i].Selected = result[i].Selected || isSelected[language]
+				continue
+			}
+			seen[d.ManualDownloadURL] = len(result)
+
+			folder := ""
+			if shipped > 1 {
+				folder = safePath(language.Language)
+			}
+			result = append(result, languageDownload{d, language.Language, folder, isSelected[language]})
+		}
+	}
+	return result
+}
+
+// splitLanguages separates the languages which have downloads for each platform from the languages which just have a
+// list of files, as movies do.
+func splitLanguages(languages []*gog.GameLanguages) (files []*gog.GameLanguages, platforms []*gog.GameLanguages) {
+	for _, language := range languages {
+		if language.Files != nil {
+			files = append(files, language)
+		} else if language.Platforms != nil {
+			platforms = append(platforms, language)
+		}
+	}
+	return files, platforms
+}
+
+func (r *run) fetchDetails(ctx context.Context, games <-chan product, gameDownload chan<- *File, extraDownload chan<- *File) {
+	// queue sends a file off to be processed, or lets everyone know that it was filtered out.
+	queue := func(downloads chan<- *File, selected bool, file *File) {
+		if !selected {
+			r.result(&Result{Type: Filtered, File: file, Path: r.basepath(file)})
+			return
+		}
+		r.lock.Lock()
+		r.filesTotal++
+		event := &Progress{Type: FilesProgress, Current: r.filesDone, Total: r.filesTotal}
+		r.lock.Unlock()
+		r.progress(event)
+		downloads <- file
+	}
+
+	for p := range games {
+		id := p.ID
+		r.debugf("Fetching details for %d", id)
+		var result *gog.GameDetails
+		var err error
+		basepath := ""
+		err = r.retry(ctx, fmt.Sprintf("details for %d", id), func() (err error) {
+			if p.MediaType == gog.MovieMediaType {
+				result, err = r.options.Client.MovieDetails(ctx, id)
+			} else {
+				result, err = r.options.Client.GameDetails(ctx, id)
+			}
+			return err
+		})
+		if p.MediaType == gog.MovieMediaType {
+			basepath = "Movies"
+		}
+		if err != nil {
+			r.debugf("Unable for fetch details for %d: %+v", id, err)
+			r.report.RunError(fmt.Errorf("Unable to fetch details for %d: %w", id, err))
+		} else {
+			var games []struct {
+				Path    string
+				Details *gog.GameDetails
+			}
+			games = append(games, struct {
+				Path    string
+				Details *gog.GameDetails
+			}{path.Join(basepath, safePath(result.Title)), result})
+			for i := 0; i < len(games); i++ {
+				basepath := games[i].Path
+				game := games[i].Details
+
+				for _, extra := range game.Extras {
+					queue(extraDownload, r.options.Filter.Extra(extra.Type), &File{
+						ProductID: id,
+						Game:      game.Title,
+						PlainName: "Extra for " + game.Title + ": " + extra.Name,
+						Size:      extra.Size,
+						URL:       gog.EmbedEndpoint + extra.ManualDownloadURL,
+						File:      path.Join(basepath, "Extras"),
+						Version:   extra.Version,
+					})
+				}
+
+				availableFiles, availablePlatforms := splitLanguages(game.Downloads)
+				selected := r.options.Filter.Languages(game.Downloads)
+
+				for _, d := range dedupeLanguages(availableFiles, selected, func(l *gog.GameLanguages) []*gog.GameDownload { return l.Files }) {
+					queue(gameDownload, d.Selected, &File{
+						ProductID: id,
+						Game:      game.Title,
+						PlainName: d.Name,
+						Size:      d.Size,
+						Language:  d.Language,
+						URL:       gog.EmbedEndpoint + d.ManualDownloadURL,
+						File:      path.Join(basepath, d.Folder),
+						Version:   d.Version,
+					})
+				}
+
+				for _, platform := range []struct {
+					Name      string
+					Downloads func(*gog.GameLanguages) []*gog.GameDownload
+				}{
+					{"Windows", func(l *gog.GameLanguages) []*gog.GameDownload { return l.Platforms.Windows }},
+					{"Mac", func(l *gog.GameLanguages) []*gog.GameDownload { return l.Platforms.Mac }},
+					{"Linux", func(l *gog.GameLanguages) []*gog.GameDownload { return l.Platforms.Linux }},
+				} {
+					if !r.options.Filter.Platform(platform.Name) {
+						continue
+					}
+					for _, d := range dedupeLanguages(availablePlatforms, selected, platform.Downloads) {
+						queue(gameDownload, d.Selected, &File{
+							ProductID: id,
+							Game:      game.Title,
+							PlainName: d.Name,
+							Size:      d.Size,
+							Platform:  platform.Name,
+							Language:  d.Language,
+							URL:       gog.EmbedEndpoint + d.ManualDownloadURL,
+							File:      path.Join(basepath, platform.Name, d.Folder),
+							Version:   d.Version,
+						})
+					}
+				}
+
+				for _, dlc := range game.DLCs {
+					games = append(games, struct {
+						Path    string
+						Details *gog.GameDetails
+					}{path.Join(basepath, safePath(dlc.Title)), dlc})
+				}
+			}
+		}
+	}
+	r.debugf("Fetched details for all files")
+
+	close(gameDownload)
+	close(extraDownload)
+}
+
+// fileProcessed counts a file as finished with.
+func (r *run) fileProcessed() {
+	r.lock.Lock()
+	r.filesDone++
+	event := &Progress{Type: FilesProgress, Current: r.filesDone, Total: r.filesTotal}
+	r.lock.Unlock()
+	r.progress(event)
+}
+
+func (e *Engine) log(level LogLevel, message string) {
+	if e.options.OnLog != nil {
+		e.options.OnLog(level, message)
+	} else {
+		log.Print(message)
+	}
+}
+
+func (e *Engine) debugf(format string, args ...interface{}) {
+	e.log(Debug, fmt.Sprintf(format, args...))
+}
+
+func (e *Engine) progress(event *Progress) {
+	if e.options.OnProgress != nil {
+		e.options.OnProgress(event)
+	}
+}
+
+func (r *run) downloaded(d *File, file string, bytes int64, previous string) {
+	r.report.FileDownloaded(d, file, bytes)
+	r.result(&Result{Type: Downloaded, File: d, Path: file, Bytes: bytes, Previous: previous})
+}
+
+func (r *run) skipped(d *File, file string, reason string) {
+	r.report.FileSkipped(d, file, reason)
+	r.result(&Result{Type: Skipped, File: d, Path: file, Reason: reason})
+}
+
+func (r *run) failed(d *File, file string, err error, attempts int) {
+	r.report.FileFailed(d, file, err)
+	r.result(&Result{Type: Failed, File: d, Path: file, Err: err, Attempts: attempts})
+}
+
+func (e *Engine) result(result *Result) {
+	if e.options.OnResult != nil {
+		e.options.OnResult(result)
+	}
+}
+
+// everything is the Filter used when none is given.
+type everything struct{}
+
+func (everything) Product(id int64, title string) bool { return true }
+func (everything) Platform(platform string) bool       { return true }
+func (everything) Extra(extraType string) bool         { return true }
+func (everything) Languages(available []*gog.GameLanguages) []*gog.GameLanguages {
+	return available
+}
+
+// noIndex is the Index used when none is given.
+type noIndex struct{}
+
+func (noIndex) Lookup(location string) *Entry                     { return nil }
+func (noIndex) LookupSource(backend string, source string) *Entry { return nil }
+func (noIndex) Record(entry *Entry) error                         { return nil }
+func (noIndex) Forget(location string) error                      { return nil }
+
+// noMetrics is the Metrics used when none are given.
+type noMetrics struct{}
+
+func (noMetrics) Downloaded(bytes int64) {}
+func (noMetrics) Uploaded(bytes int64)   {}
+func (noMetrics) Retried()               {}
@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+func TestDedupeLanguages(t *testing.T) {
+	download := func(url string) *gog.GameDownload {
+		return &gog.GameDownload{ManualDownloadURL: url, Name: url}
+	}
+	english := &gog.GameLanguages{Language: "English", Files: []*gog.GameDownload{download("/en"), download("/shared")}}
+	german := &gog.GameLanguages{Language: "German", Files: []*gog.GameDownload{download("/de"), download("/shared")}}
+	files := func(l *gog.GameLanguages) []*gog.GameDownload { return l.Files }
+
+	folders := func(result []languageDownload) map[string]string {
+		m := make(map[string]string)
+		for _, d := range result {
+			if d.Selected {
+				m[d.ManualDownloadURL] = d.Folder
+			}
+		}
+		return m
+	}
+
+	// Filtering down to a single language doesn't change where anything is stored.
+	all := folders(dedupeLanguages([]*gog.GameLanguages{english, german}, []*gog.GameLanguages{english, german}, files))
+	filtered := folders(dedupeLanguages([]*gog.GameLanguages{english, german}, []*gog.GameLanguages{english}, files))
+	if len(all) != 3 || all["/en"] != "English" || all["/de"] != "German" || all["/shared"] != "" {
+		t.Errorf("Unexpected folders for every language: %v", all)
+	}
+	if len(filtered) != 2 || filtered["/en"] != "English" || filtered["/shared"] != "" {
+		t.Errorf("Unexpected folders for a single language: %v", filtered)
+	}
+
+	// Games which are only available in one language don't get a language folder.
+	single := dedupeLanguages([]*gog.GameLanguages{english}, []*gog.GameLanguages{english}, files)
+	for _, d := range single {
+		if d.Folder != "" {
+			t.Errorf("%s shouldn't be in a language folder, got %s", d.ManualDownloadURL, d.Folder)
+		}
+	}
+	if len(single) != 2 || single[0].Language != "English" {
+		t.Errorf("Unexpected downloads for a single language game: %+v", single)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	e := &Engine{options: Options{RetryDelay: time.Second, RetryMaxDelay: time.Minute}}
+	for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: time.Minute, 1000: time.Minute} {
+		if delay := e.backoff(attempt, nil); delay < max/2 || delay > max {
+			t.Errorf("Attempt %d: expected a delay between %s and %s, got %s", attempt, max/2, max, delay)
+		}
+	}
+
+	// Without a limit the delay still stops growing eventually, rather than overflowing.
+	e.options.RetryMaxDelay = 0
+	capped := time.Second << maxDoublings
+	for _, attempt := range []int{maxDoublings + 1, 64, 1000} {
+		if delay := e.backoff(attempt, nil); delay < capped/2 || delay > capped {
+			t.Errorf("Attempt %d: expected a delay between %s and %s, got %s", attempt, capped/2, capped, delay)
+		}
+	}
+
+	if delay := e.backoff(1, &gog.RateLimitError{StatusCode: 429, RetryAfter: time.Hour}); delay != time.Hour {
+		t.Errorf("Expected to wait as long as GoG asked, got %s", delay)
+	}
+}
@@ -0,0 +1,411 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/mscharley/gog-backup/internal/gog-backup/index"
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+// meter counts the bytes read through it.
+type meter struct {
+	io.Reader
+	count int64
+	// err is the first error other than io.EOF returned by the underlying reader.
+	err error
+	// metric is optional, if provided then it is called with the number of bytes in every read.
+	metric func(bytes int64)
+	// onRead is optional, if provided then it is called with the total so far after every read.
+	onRead func(count int64)
+}
+
+func (m *meter) Read(p []byte) (int, error) {
+	n, err := m.Reader.Read(p)
+	m.count += int64(n)
+	if err != nil && err != io.EOF && m.err == nil {
+		m.err = err
+	}
+	if m.metric != nil && n > 0 {
+		m.metric(int64(n))
+	}
+	if m.onRead != nil && n > 0 {
+		m.onRead(m.count)
+	}
+	return n, err
+}
+
+// verifier checks everything read through it against an MD5 checksum, failing the last read instead of returning
+// io.EOF if it doesn't match so that the backend never stores a corrupt file.
+type verifier struct {
+	io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	if err == io.EOF {
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); !strings.EqualFold(sum, v.expected) {
+			return n, &ChecksumError{Expected: v.expected, Actual: sum}
+		}
+	}
+	return n, err
+}
+
+// record adds a file which has been backed up to the index.
+func (r *run) record(d *File, location string, file string, size int64, md5 string) error {
+	return r.options.Index.Record(&Entry{
+		ProductID: d.ProductID,
+		File:      file,
+		Version:   d.Version,
+		Size:      size,
+		MD5:       md5,
+		Location:  location,
+		Source:    d.URL,
+	})
+}
+
+// download backs up a single file, retrying with a backoff if anything goes wrong.
+func (r *run) download(ctx context.Context, d *File, basepath string) bool {
+	var err error
+	var filename string
+	attempts := 0
+	for attempts < r.options.Retries && ctx.Err() == nil {
+		attempts++
+		if attempts > 1 {
+			r.options.Metrics.Retried()
+		}
+		var name string
+		if name, err = r.attempt(ctx, d, attempts, basepath); err == nil {
+			return true
+		} else if name != "" {
+			filename = name
+		}
+		if gog.IsPermanent(err) {
+			r.debugf("Not retrying %s as it won't work next time either: %+v", d.PlainName, err)
+			break
+		}
+		if attempts < r.options.Retries {
+			delay := r.backoff(attempts, err)
+			r.debugf("Retrying %s in %s.", d.PlainName, delay)
+			sleep(ctx, delay)
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	r.failed(d, r.filePath(d, basepath, filename), err, attempts)
+	return false
+}
+
+// retry makes a request to GoG, trying again with the same backoff as downloads if it fails. what describes the
+// request for the log.
+func (r *run) retry(ctx context.Context, what string, request func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := request()
+		if err == nil || gog.IsPermanent(err) || attempt >= r.options.Retries || ctx.Err() != nil {
+			return err
+		}
+		delay := r.backoff(attempt, err)
+		r.debugf("Retrying %s in %s: %+v", what, delay, err)
+		if !sleep(ctx, delay) {
+			return err
+		}
+	}
+}
+
+// attempt makes a single attempt at backing up a file, returning what the file is called if GoG got far enough to
+// tell us.
+func (r *run) attempt(ctx context.Context, d *File, attempt int, basepath string) (filename string, err error) {
+	client := r.options.Client
+	handler := r.options.Handler
+	dryRun := r.options.DryRun
+
+	fail := func(err error, format string, args ...interface{}) error {
+		r.log(Info, fmt.Sprintf(format, args...))
+		return err
+	}
+
+	filename, readerTmp, contentLength, err := client.DownloadFile(ctx, d.URL)
+
+	var platform string
+	if d.Platform != "" {
+		platform = " " + "[" + d.Platform + "]"
+	}
+
+	if err != nil {
+		return filename, fail(err, "[%d] Unable to connect to GoG for %s%s (%s): %#v\n", attempt, d.PlainName, platform, d.URL, err)
+	}
+	if contentLength == nil {
+		readerTmp.Close()
+		err = fmt.Errorf("No Content-Length available for %s", d.URL)
+		return filename, fail(err, "[%d] %s", attempt, err)
+	}
+
+	file := path.Join(basepath, filename)
+	var reader io.Reader = readerTmp
+	if r.options.DownloadBucket != nil {
+		reader = ratelimit.Reader(reader, r.options.DownloadBucket)
+	}
+
+	// Check for version information from last time. The index is preferred but anything backed up before it existed
+	// will only have a version file, in which case we add it to the index for next time.
+	versionFile := path.Join(basepath, "."+filename+".version")
+	location := index.Location(handler, file)
+	entry := r.options.Index.Lookup(location)
+	var previous string
+	if entry != nil {
+		previous = entry.Version
+	}
+	if d.Version != "" {
+		if entry == nil {
+			previous, _ = handler.ReadFile(ctx, versionFile)
+		}
+		if previous == d.Version {
+			r.debugf("Skipping %s%s as it is already up to date.", d.PlainName, platform)
+			readerTmp.Close()
+			if entry == nil {
+				r.record(d, location, file, *contentLength, "")
+			}
+			r.skipped(d, file, "up to date")
+			return filename, nil
+		}
+	} else if entry != nil {
+		r.debugf("Skipping %s%s as it is already backed up and isn't versioned.", d.PlainName, platform)
+		readerTmp.Close()
+		r.skipped(d, file, "already backed up")
+		return filename, nil
+	} else if info, _ := handler.FileExists(ctx, file); info {
+		r.debugf("Skipping %s%s as it is already backed up and isn't versioned.", d.PlainName, platform)
+		readerTmp.Close()
+		r.record(d, location, file, *contentLength, "")
+		r.skipped(d, file, "already backed up")
+		return filename, nil
+	}
+
+	// Work out which file this is replacing. GoG sometimes renames files in an update, in which case the previous
+	// version is found by where it was downloaded from instead.
+	replaced := file
+	var replacedEntry *Entry
+	if previous == "" && d.Version != "" {
+		if source := r.options.Index.LookupSource(index.Location(handler, ""), d.URL); source != nil && source.File != file {
+			replaced, replacedEntry, previous = source.File, source, source.Version
+		}
+	}
+	archive := r.archiving() && d.Version != "" && !dryRun && previous != "" && previous != d.Version
+
+	// Continue on from an interrupted transfer if the backend kept one around for us.
+	var offset int64
+	resumer, canResume := handler.(backend.Resumer)
+	if canResume && !dryRun {
+		if partial, _ := resumer.PartialSize(ctx, basepath, filename); partial > 0 && partial < *contentLength {
+			r.debugf("Resuming %s%s from byte %d.", d.PlainName, platform, partial)
+			readerTmp.Close()
+			_, readerTmp, contentLength, offset, err = client.DownloadFileRange(ctx, d.URL, partial)
+			var statusErr *gog.StatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				// The file has changed since the partial download was made, so it's no use any more.
+				r.debugf("Unable to resume %s%s, starting again from the beginning.", d.PlainName, platform)
+				if err = handler.Delete(ctx, backend.PartialPath(basepath, filename)); err != nil {
+					r.debugf("Unable to remove the partial download of %s%s: %+v", d.PlainName, platform, err)
+				}
+				_, readerTmp, contentLength, err = client.DownloadFile(ctx, d.URL)
+			}
+			if err != nil {
+				return filename, fail(err, "[%d] Unable to connect to GoG for %s%s (%s): %#v\n", attempt, d.PlainName, platform, d.URL, err)
+			}
+			if contentLength == nil {
+				readerTmp.Close()
+				err = fmt.Errorf("No Content-Length available for %s", d.URL)
+				return filename, fail(err, "[%d] %s", attempt, err)
+			}
+			reader = readerTmp
+			if r.options.DownloadBucket != nil {
+				reader = ratelimit.Reader(reader, r.options.DownloadBucket)
+			}
+		}
+	}
+	defer readerTmp.Close()
+
+	// Hash everything on the way through so that we can check it against what GoG thinks we should have received,
+	// and so that we can check it again later.
+	var checksum *gog.FileChecksum
+	var hasher hash.Hash
+	if r.options.Checksums && !dryRun {
+		checksum, err = client.GetChecksum(ctx, d.URL)
+		if err != nil {
+			r.debugf("Unable to fetch checksum for %s%s, it won't be verified: %+v", d.PlainName, platform, err)
+		}
+	}
+	if !dryRun {
+		hasher = md5.New()
+		if offset > 0 {
+			partial, err := resumer.OpenPartial(ctx, basepath, filename)
+			if err == nil {
+				_, err = io.CopyN(hasher, partial, offset)
+				partial.Close()
+			}
+			if err != nil {
+				return filename, fail(err, "[%d] Unable to read partial download for %s%s: %#v", attempt, d.PlainName, platform, err)
+			}
+		}
+		reader = io.TeeReader(reader, hasher)
+		if checksum != nil {
+			reader = &verifier{Reader: reader, hash: hasher, expected: checksum.MD5}
+		}
+	}
+
+	total := offset + *contentLength
+	counter := &meter{Reader: reader, metric: r.options.Metrics.Downloaded}
+	if r.options.OnProgress != nil {
+		counter.onRead = func(count int64) {
+			r.progress(&Progress{Type: TransferProgress, File: d, Attempt: attempt, Current: offset + count, Total: total})
+		}
+	}
+	reader = counter
+
+	r.progress(&Progress{Type: TransferStarted, File: d, Attempt: attempt, Current: offset, Total: total, Destination: handler.GetDisplayPrefix() + "/" + file})
+	defer func() {
+		r.progress(&Progress{Type: TransferFinished, File: d, Attempt: attempt, Current: offset + counter.count, Total: total})
+	}()
+
+	if dryRun {
+		r.skipped(d, file, "dry run")
+		return filename, nil
+	}
+
+	// If the new version is going to overwrite the one we're keeping then move it out of the way first, and put it back
+	// if the new version doesn't make it.
+	var archived string
+	succeeded := false
+	if archive && replaced == file {
+		if archived, err = r.archiveFile(ctx, basepath, d, file, previous); err != nil {
+			return filename, fail(err, "[%d] Unable to archive the previous version of %s%s: %#v", attempt, d.PlainName, platform, err)
+		}
+		defer func() {
+			if archived != "" && !succeeded {
+				// This needs to happen even if the run has been cancelled.
+				if err := handler.Rename(context.Background(), archived, file); err != nil {
+					r.debugf("Unable to restore the previous version of %s%s from %s: %+v", d.PlainName, platform, archived, err)
+				}
+			}
+		}()
+	}
+
+	copies := int64(backend.Replicas(ctx, handler, basepath, filename, d))
+	reader = &meter{Reader: reader, metric: func(bytes int64) { r.options.Metrics.Uploaded(bytes * copies) }}
+	if offset > 0 {
+		err = resumer.ResumeFile(ctx, reader, basepath, filename, offset)
+	} else {
+		err = handler.TransferFile(ctx, reader, basepath, filename, d)
+	}
+
+	if err != nil {
+		// Anything which went wrong on GoG's end shows up here too, it's only the backend's fault if it wasn't that.
+		if counter.err != nil {
+			err = counter.err
+		} else if ctx.Err() == nil {
+			err = &BackendError{err}
+		}
+		if _, mismatch := counter.err.(*ChecksumError); mismatch {
+			// Resuming from what we've got would only give us the same corrupt file again.
+			if canResume {
+				if err := handler.Delete(ctx, backend.PartialPath(basepath, filename)); err != nil {
+					r.debugf("Unable to remove the partial download of %s%s: %+v", d.PlainName, platform, err)
+				}
+			}
+			return filename, fail(err, "[%d] %s for %s%s (%s)", attempt, err, d.PlainName, platform, d.URL)
+		}
+		return filename, fail(err, "[%d] Unable to download file for %s%s (%s): %#v", attempt, d.PlainName, platform, d.URL, err)
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	succeeded = true
+
+	if archive {
+		if replaced != file {
+			archived, err = r.archiveFile(ctx, basepath, d, replaced, previous)
+			if err == nil && archived != "" {
+				// A version file left next to a file which has been renamed by GoG would never be cleaned up.
+				err = handler.Delete(ctx, path.Join(path.Dir(replaced), "."+path.Base(replaced)+".version"))
+			}
+		}
+		if err == nil && archived != "" {
+			err = r.finishArchive(ctx, basepath, d, archived, previous)
+		}
+		if err != nil {
+			r.debugf("Unable to archive the previous version of %s%s: %+v", d.PlainName, platform, err)
+		} else if replacedEntry != nil && archived != "" {
+			if err = r.options.Index.Forget(replacedEntry.Location); err != nil {
+				r.debugf("Unable to save the index: %+v", err)
+			}
+		}
+	}
+	r.downloaded(d, file, counter.count, previous)
+	if err = r.record(d, location, file, total, sum); err != nil {
+		r.debugf("Unable to save the index: %+v", err)
+	}
+
+	if d.Version != "" {
+		// Save version information for next time.
+		err = handler.WriteFile(ctx, versionFile, d.Version)
+		if err != nil {
+			r.debugf("Unable to save version file: %+v", err)
+			// Good enough for this run through - we'll redownload next time and retry saving the version file then.
+			return filename, nil
+		}
+	}
+
+	// We successfully managed to download this file, skip the rest of our retries.
+	return filename, nil
+}
+
+// maxDoublings stops the delay between retries from growing forever when there's no RetryMaxDelay.
+const maxDoublings = 10
+
+// backoff works out how long to wait after a failed attempt before the next one. The wait grows exponentially with
+// each attempt and is jittered so that concurrent downloads don't all retry at the same moment, but GoG gets the final
+// say if it sent a Retry-After header.
+func (e *Engine) backoff(attempt int, err error) time.Duration {
+	delay := e.options.RetryDelay
+	limit := e.options.RetryMaxDelay
+	for i := 1; i < attempt && i <= maxDoublings && (limit == 0 || delay < limit); i++ {
+		delay *= 2
+	}
+	if limit > 0 && delay > limit {
+		delay = limit
+	}
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	if after := gog.RetryAfter(err); after > delay {
+		delay = after
+	}
+	return delay
+}
+
+// sleep waits for a while, returning early with false if ctx is cancelled first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
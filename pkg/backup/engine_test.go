@@ -0,0 +1,542 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mscharley/gog-backup/pkg/backend"
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+// fakeGoG serves a library with a single game which has a single installer.
+type fakeGoG struct {
+	*httptest.Server
+	lock     sync.Mutex
+	version  string
+	filename string
+	content  []byte
+	// rangeNotSatisfiable rejects any request to resume a download, like GoG does once a file has changed.
+	rangeNotSatisfiable bool
+	// ranges is every Range header which was asked for.
+	ranges []string
+	// checksum is the MD5 published for the installer, if any.
+	checksum string
+	// rateLimited is how many more requests for the game's details are turned away with a Retry-After.
+	rateLimited int
+}
+
+func newFakeGoG(t *testing.T) *fakeGoG {
+	g := &fakeGoG{version: "1.0", filename: "setup_1.0.exe", content: []byte("version 1.0 of the installer")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "refresh_token": "refresh", "expires_in": 3600})
+	})
+	mux.HandleFunc("/account/getFilteredProducts", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&gog.FilteredProductPage{Page: 1, TotalPages: 1, TotalProducts: 1, Products: []gog.FilteredProduct{{ID: 1, Title: "Some Game"}}})
+	})
+	mux.HandleFunc("/account/gameDetails/1.json", func(w http.ResponseWriter, r *http.Request) {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		if g.rateLimited > 0 {
+			g.rateLimited--
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintf(w, `{"title": "Some Game", "downloads": [["English", {"windows": [{"manualUrl": "/downloads/some_game/en1installer0", "name": "Some Game", "version": %q, "size": "1 MB"}]}]]}`, g.version)
+	})
+	mux.HandleFunc("/downloads/some_game/en1installer0", func(w http.ResponseWriter, r *http.Request) {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		http.Redirect(w, r, "/files/"+g.filename, http.StatusFound)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		if path.Base(r.URL.Path) == g.filename+".xml" && g.checksum != "" {
+			fmt.Fprintf(w, `<file name=%q available="1" md5=%q total_size="%d"></file>`, g.filename, g.checksum, len(g.content))
+			return
+		}
+		if path.Base(r.URL.Path) != g.filename {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			g.ranges = append(g.ranges, r.Header.Get("Range"))
+		}
+		if g.rangeNotSatisfiable && r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		http.ServeContent(w, r, g.filename, time.Time{}, bytes.NewReader(g.content))
+	})
+	g.Server = httptest.NewServer(mux)
+	t.Cleanup(g.Close)
+	return g
+}
+
+// update releases a new version of the installer under the same filename.
+func (g *fakeGoG) update(version string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.version = version
+	g.content = []byte("version " + version + " of the installer")
+}
+
+// client talks to the fake instead of GoG.
+func (g *fakeGoG) client() *gog.Client {
+	target, _ := url.Parse(g.URL)
+	return &gog.Client{
+		Client: &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+			r = r.Clone(r.Context())
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			return http.DefaultTransport.RoundTrip(r)
+		})},
+		AuthURL:      g.URL,
+		RefreshToken: "refresh",
+	}
+}
+
+type roundTripper func(r *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// memoryHandler keeps everything in memory, including interrupted transfers.
+type memoryHandler struct {
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func newMemoryHandler() *memoryHandler {
+	return &memoryHandler{files: make(map[string][]byte)}
+}
+
+func (h *memoryHandler) get(name string) ([]byte, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	content, ok := h.files[name]
+	return content, ok
+}
+
+func (h *memoryHandler) put(name string, content []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.files[name] = content
+}
+
+func (h *memoryHandler) names() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var names []string
+	for name := range h.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *memoryHandler) GetPrefix() string        { return "" }
+func (h *memoryHandler) GetDisplayPrefix() string { return "memory:" }
+
+func (h *memoryHandler) ReadFile(ctx context.Context, filename string) (string, error) {
+	content, ok := h.get(filename)
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return string(content), nil
+}
+
+func (h *memoryHandler) WriteFile(ctx context.Context, filename string, content string) error {
+	h.put(filename, []byte(content))
+	return nil
+}
+
+func (h *memoryHandler) FileExists(ctx context.Context, filename string) (bool, error) {
+	_, ok := h.get(filename)
+	return ok, nil
+}
+
+func (h *memoryHandler) OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	content, ok := h.get(filename)
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+}
+
+func (h *memoryHandler) Stat(ctx context.Context, filename string) (*backend.FileInfo, error) {
+	content, ok := h.get(filename)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &backend.FileInfo{Name: filename, Size: int64(len(content))}, nil
+}
+
+func (h *memoryHandler) Delete(ctx context.Context, filename string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.files, filename)
+	return nil
+}
+
+func (h *memoryHandler) Rename(ctx context.Context, oldname string, newname string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	content, ok := h.files[oldname]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(h.files, oldname)
+	h.files[newname] = content
+	return nil
+}
+
+func (h *memoryHandler) List(ctx context.Context, prefix string) ([]backend.FileInfo, error) {
+	var files []backend.FileInfo
+	for _, name := range h.names() {
+		if strings.HasPrefix(name, prefix+"/") {
+			content, _ := h.get(name)
+			files = append(files, backend.FileInfo{Name: name, Size: int64(len(content)), ModTime: time.Now()})
+		}
+	}
+	return files, nil
+}
+
+func (h *memoryHandler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	return h.ResumeFile(ctx, reader, basepath, filename, 0)
+}
+
+func (h *memoryHandler) PartialSize(ctx context.Context, basepath string, filename string) (int64, error) {
+	content, _ := h.get(backend.PartialPath(basepath, filename))
+	return int64(len(content)), nil
+}
+
+func (h *memoryHandler) OpenPartial(ctx context.Context, basepath string, filename string) (io.ReadCloser, error) {
+	content, ok := h.get(backend.PartialPath(basepath, filename))
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// ResumeFile keeps whatever it managed to read as a partial transfer if anything goes wrong, like the local backend.
+func (h *memoryHandler) ResumeFile(ctx context.Context, reader io.Reader, basepath string, filename string, offset int64) error {
+	partial, _ := h.get(backend.PartialPath(basepath, filename))
+	rest, err := ioutil.ReadAll(reader)
+	content := append(partial[:offset:offset], rest...)
+	if err != nil {
+		h.put(backend.PartialPath(basepath, filename), content)
+		return err
+	}
+	h.Delete(ctx, backend.PartialPath(basepath, filename))
+	h.put(path.Join(basepath, filename), content)
+	return nil
+}
+
+// countingMetrics remembers everything the Engine measured.
+type countingMetrics struct {
+	lock       sync.Mutex
+	downloaded int64
+	uploaded   int64
+	retried    int
+}
+
+func (m *countingMetrics) Downloaded(bytes int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.downloaded += bytes
+}
+
+func (m *countingMetrics) Uploaded(bytes int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.uploaded += bytes
+}
+
+func (m *countingMetrics) Retried() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.retried++
+}
+
+// testRun runs a backup, returning what happened to every file.
+func testRun(t *testing.T, options Options) []*Result {
+	t.Helper()
+	var lock sync.Mutex
+	var results []*Result
+	options.OnResult = func(result *Result) {
+		lock.Lock()
+		defer lock.Unlock()
+		results = append(results, result)
+	}
+	if options.OnLog == nil {
+		options.OnLog = func(level LogLevel, message string) { t.Log(message) }
+	}
+	e, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := e.Backup(context.Background(), context.Background())
+	if errs := report.RunErrors(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %+v", errs)
+	}
+	return results
+}
+
+// describe shows what happened in a failed test.
+func describe(results []*Result) string {
+	var lines []string
+	for _, result := range results {
+		lines = append(lines, fmt.Sprintf("%+v", *result))
+	}
+	return "[" + strings.Join(lines, ", ") + "]"
+}
+
+func TestEngineBackup(t *testing.T) {
+	g := newFakeGoG(t)
+	h := newMemoryHandler()
+	metrics := &countingMetrics{}
+	var logs []string
+	var lock sync.Mutex
+	options := Options{Client: g.client(), Handler: h, Metrics: metrics, OnLog: func(level LogLevel, message string) {
+		lock.Lock()
+		defer lock.Unlock()
+		logs = append(logs, message)
+	}}
+
+	results := testRun(t, options)
+	if len(results) != 1 || results[0].Type != Downloaded || results[0].Path != "Some Game/Windows/setup_1.0.exe" {
+		t.Fatalf("Expected the installer to be downloaded, got %s", describe(results))
+	}
+	if d := results[0].File; d.PlainName != "Some Game" || d.Platform != "Windows" || d.Size != "1 MB" || strings.Contains(d.PlainName, "\x1b") {
+		t.Errorf("Unexpected file: %+v", d)
+	}
+	if content, _ := h.get("Some Game/Windows/setup_1.0.exe"); string(content) != "version 1.0 of the installer" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+	if version, _ := h.get("Some Game/Windows/.setup_1.0.exe.version"); string(version) != "1.0" {
+		t.Errorf("Expected the version to be saved, got %q", version)
+	}
+	size := int64(len("version 1.0 of the installer"))
+	if metrics.downloaded != size || metrics.uploaded != size || metrics.retried != 0 {
+		t.Errorf("Unexpected metrics: %+v", metrics)
+	}
+	if len(logs) == 0 {
+		t.Errorf("Expected the Engine to log through OnLog")
+	}
+
+	// Nothing needs to happen the second time around.
+	results = testRun(t, options)
+	if len(results) != 1 || results[0].Type != Skipped || results[0].Reason != "up to date" {
+		t.Errorf("Expected the installer to be skipped, got %s", describe(results))
+	}
+}
+
+func TestEngineRetriesRateLimits(t *testing.T) {
+	g := newFakeGoG(t)
+	g.rateLimited = 1
+	h := newMemoryHandler()
+
+	start := time.Now()
+	results := testRun(t, Options{Client: g.client(), Handler: h, Retries: 3, RetryDelay: time.Millisecond})
+	if len(results) != 1 || results[0].Type != Downloaded {
+		t.Fatalf("Expected the game to be backed up once GoG let us, got %s", describe(results))
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected to wait as long as GoG asked, only waited %s", elapsed)
+	}
+}
+
+func TestEngineClientLog(t *testing.T) {
+	g := newFakeGoG(t)
+	var lock sync.Mutex
+	var messages []string
+	testRun(t, Options{Client: g.client(), Handler: newMemoryHandler(), OnLog: func(level LogLevel, message string) {
+		lock.Lock()
+		defer lock.Unlock()
+		messages = append(messages, message)
+	}})
+
+	for _, message := range messages {
+		if strings.Contains(message, "access token") {
+			return
+		}
+	}
+	t.Errorf("Expected the client's messages to be logged along with the engine's, got %q", messages)
+}
+
+func TestEngineArchivesUpdates(t *testing.T) {
+	g := newFakeGoG(t)
+	h := newMemoryHandler()
+	options := Options{Client: g.client(), Handler: h, KeepVersions: 1}
+	testRun(t, options)
+
+	g.update("1.1")
+	results := testRun(t, options)
+	if len(results) != 1 || results[0].Type != Downloaded || results[0].Previous != "1.0" {
+		t.Fatalf("Expected the update to be downloaded, got %s", describe(results))
+	}
+	if content, _ := h.get("Some Game/Windows/setup_1.0.exe"); string(content) != "version 1.1 of the installer" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+	if content, _ := h.get("Some Game/Windows/.archive/en1installer0/1.0/setup_1.0.exe"); string(content) != "version 1.0 of the installer" {
+		t.Errorf("Expected the previous version to be archived, got %q in %v", content, h.names())
+	}
+	if version, _ := h.get("Some Game/Windows/.setup_1.0.exe.version"); string(version) != "1.1" {
+		t.Errorf("Expected the new version to be saved, got %q", version)
+	}
+}
+
+func TestEngineKeepsVersionOnFailedUpdate(t *testing.T) {
+	g := newFakeGoG(t)
+	h := newMemoryHandler()
+	options := Options{Client: g.client(), Handler: h, KeepVersions: 1, Checksums: true}
+	testRun(t, options)
+
+	g.update("1.1")
+	g.checksum = "0123456789abcdef0123456789abcdef"
+	results := testRun(t, options)
+	if len(results) != 1 || results[0].Type != Failed {
+		t.Fatalf("Expected the update to fail, got %s", describe(results))
+	}
+	if content, _ := h.get("Some Game/Windows/setup_1.0.exe"); string(content) != "version 1.0 of the installer" {
+		t.Errorf("Expected the previous version to be put back, got %q", content)
+	}
+	if version, _ := h.get("Some Game/Windows/.setup_1.0.exe.version"); string(version) != "1.0" {
+		t.Errorf("Expected the previous version to still be recorded, got %q in %v", version, h.names())
+	}
+
+	// The next run still knows which version it's replacing.
+	g.checksum = ""
+	results = testRun(t, options)
+	if len(results) != 1 || results[0].Type != Downloaded || results[0].Previous != "1.0" {
+		t.Fatalf("Expected the update to be downloaded, got %s", describe(results))
+	}
+	if content, _ := h.get("Some Game/Windows/.archive/en1installer0/1.0/setup_1.0.exe"); string(content) != "version 1.0 of the installer" {
+		t.Errorf("Expected the previous version to be archived, got %q in %v", content, h.names())
+	}
+}
+
+func TestEngineRestartsChangedDownloads(t *testing.T) {
+	g := newFakeGoG(t)
+	g.rangeNotSatisfiable = true
+	h := newMemoryHandler()
+	h.put("Some Game/Windows/.setup_1.0.exe.tmp", []byte("an older vers"))
+	metrics := &countingMetrics{}
+
+	results := testRun(t, Options{Client: g.client(), Handler: h, Metrics: metrics})
+	if len(results) != 1 || results[0].Type != Downloaded {
+		t.Fatalf("Expected the installer to be downloaded from the beginning, got %s", describe(results))
+	}
+	if content, _ := h.get("Some Game/Windows/setup_1.0.exe"); string(content) != "version 1.0 of the installer" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+	if _, exists := h.get("Some Game/Windows/.setup_1.0.exe.tmp"); exists {
+		t.Errorf("The partial download which couldn't be resumed should have been removed")
+	}
+	if size := int64(len(g.content)); metrics.downloaded != size {
+		t.Errorf("Expected all %d bytes to be downloaded again, got %d", size, metrics.downloaded)
+	}
+}
+
+func TestEngineResumesDownloads(t *testing.T) {
+	g := newFakeGoG(t)
+	h := newMemoryHandler()
+	h.put("Some Game/Windows/.setup_1.0.exe.tmp", []byte("version 1.0"))
+	metrics := &countingMetrics{}
+
+	results := testRun(t, Options{Client: g.client(), Handler: h, Metrics: metrics})
+	if len(results) != 1 || results[0].Type != Downloaded {
+		t.Fatalf("Expected the installer to be downloaded, got %s", describe(results))
+	}
+	if content, _ := h.get("Some Game/Windows/setup_1.0.exe"); string(content) != "version 1.0 of the installer" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+	if _, exists := h.get("Some Game/Windows/.setup_1.0.exe.tmp"); exists {
+		t.Errorf("The partial download should have been used up")
+	}
+	if len(g.ranges) != 1 || g.ranges[0] != "bytes=11-" {
+		t.Errorf("Expected to only ask for the rest of the file, got %v", g.ranges)
+	}
+	if rest := int64(len(g.content) - len("version 1.0")); metrics.downloaded != rest {
+		t.Errorf("Expected only the remaining %d bytes to be downloaded, got %d", rest, metrics.downloaded)
+	}
+	if version, _ := h.get("Some Game/Windows/.setup_1.0.exe.version"); string(version) != "1.0" {
+		t.Errorf("Expected the version to be saved, got %q", version)
+	}
+}
+
+func TestEngineChecksums(t *testing.T) {
+	g := newFakeGoG(t)
+	h := newMemoryHandler()
+	sum := md5.Sum(g.content)
+	g.checksum = hex.EncodeToString(sum[:])
+	h.put("Some Game/Windows/.setup_1.0.exe.tmp", []byte("version 1.0"))
+	options := Options{Client: g.client(), Handler: h, Checksums: true}
+
+	// Resumed downloads are checked as a whole.
+	results := testRun(t, options)
+	if len(results) != 1 || results[0].Type != Downloaded {
+		t.Fatalf("Expected the installer to be downloaded, got %s", describe(results))
+	}
+
+	g.update("1.1")
+	g.checksum = "0123456789abcdef0123456789abcdef"
+	results = testRun(t, options)
+	var mismatch *ChecksumError
+	if len(results) != 1 || results[0].Type != Failed || !errors.As(results[0].Err, &mismatch) {
+		t.Fatalf("Expected the update to fail its checksum, got %s", describe(results))
+	}
+	if content, _ := h.get("Some Game/Windows/setup_1.0.exe"); string(content) != "version 1.0 of the installer" {
+		t.Errorf("The corrupt download shouldn't have replaced the previous version, got %q", content)
+	}
+	if version, _ := h.get("Some Game/Windows/.setup_1.0.exe.version"); string(version) != "1.0" {
+		t.Errorf("Expected the previous version to still be recorded, got %q", version)
+	}
+	if _, exists := h.get("Some Game/Windows/.setup_1.0.exe.tmp"); exists {
+		t.Errorf("The corrupt download shouldn't be kept around to resume from")
+	}
+}
+
+func TestEngineFailedPath(t *testing.T) {
+	g := newFakeGoG(t)
+	h := &failingHandler{newMemoryHandler()}
+
+	results := testRun(t, Options{Client: g.client(), Handler: h})
+	if len(results) != 1 || results[0].Type != Failed || results[0].Path != "Some Game/Windows/setup_1.0.exe" {
+		t.Errorf("Expected the failure to be recorded against the file, got %s", describe(results))
+	}
+	var backendErr *BackendError
+	if !errors.As(results[0].Err, &backendErr) {
+		t.Errorf("Expected a backend error, got %+v", results[0].Err)
+	}
+}
+
+// failingHandler can't store anything.
+type failingHandler struct {
+	*memoryHandler
+}
+
+func (h *failingHandler) TransferFile(ctx context.Context, reader io.Reader, basepath string, filename string, source *backend.GogFile) error {
+	return errors.New("disk full")
+}
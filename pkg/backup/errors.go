@@ -0,0 +1,25 @@
+package backup
+
+// BackendError is why a file failed when it was downloaded from GoG but couldn't be stored in the backend.
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return "Unable to store file in the backend: " + e.Err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumError is why a file failed when what was downloaded doesn't match the checksum published by GoG. The file
+// isn't stored when this happens.
+type ChecksumError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return "Checksum mismatch: expected " + e.Expected + " but got " + e.Actual
+}
@@ -0,0 +1,64 @@
+package backup
+
+// ProgressType is what a Progress event is describing.
+type ProgressType int8
+
+const (
+	// GamesProgress counts the games and movies in the library which have been processed.
+	GamesProgress ProgressType = iota + 1
+	// FilesProgress counts the files which have been processed.
+	FilesProgress
+	// TransferStarted is sent when a file starts to be downloaded.
+	TransferStarted
+	// TransferProgress counts the bytes of a file which have been downloaded so far.
+	TransferProgress
+	// TransferFinished is sent when a download stops, whether it was successful or not.
+	TransferFinished
+)
+
+// Progress describes how far through a run the Engine is.
+type Progress struct {
+	Type    ProgressType
+	Current int64
+	Total   int64
+	// Final is set once Total won't change any more.
+	Final bool
+	// File and Attempt are only set for transfers.
+	File    *File
+	Attempt int
+	// Destination is where the file is being stored, as it should be displayed to the user. It is only set for
+	// TransferStarted.
+	Destination string
+}
+
+// ResultType is what happened to a file.
+type ResultType int8
+
+const (
+	// Downloaded files were backed up during this run.
+	Downloaded ResultType = iota + 1
+	// Skipped files didn't need to be backed up, see Result.Reason.
+	Skipped
+	// Failed files couldn't be backed up, see Result.Err.
+	Failed
+	// Filtered files are in the library but were left out by the Filter. Their Path is the folder they would have
+	// been stored in. These aren't counted in the Report.
+	Filtered
+)
+
+// Result describes what happened to a single file during a run.
+type Result struct {
+	Type ResultType
+	File *File
+	// Path is where the file is stored in the backend.
+	Path string
+	// Bytes is how many bytes were downloaded.
+	Bytes int64
+	// Previous is the version of the file which was replaced, if it was versioned and had been backed up before.
+	Previous string
+	// Reason is why the file was skipped.
+	Reason string
+	// Err is why the file failed, after Attempts attempts.
+	Err      error
+	Attempts int
+}
@@ -1,11 +1,15 @@
 package gog
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 )
@@ -16,6 +20,9 @@ const AuthEndpoint = "https://auth.gog.com"
 // EmbedEndpoint is the base URL for the embed API.
 const EmbedEndpoint = "https://embed.gog.com"
 
+// loginRedirectURL is where GoG sends users after they log in, the code we need is added to this address.
+const loginRedirectURL = EmbedEndpoint + "/on_login_success?origin=client"
+
 // These are 'borrowed' from the Galaxy Client.
 // See also: https://gogapidocs.readthedocs.io/en/latest/auth.html
 const clientID = "46899977096215655"
@@ -25,9 +32,20 @@ const clientSecret = "9d85c43b1482497dbbce61f6e4aa173a433796eeae2ca8c5f6129f2dc4
 type Client struct {
 	*http.Client
 	RefreshToken string
-	accessToken  *string
-	tokenExpiry  int64
-	lock         sync.Mutex
+	// AuthURL overrides the base URL used for authentication, by default AuthEndpoint is used.
+	AuthURL string
+	// TokenStore is optional, if provided then it will be used to save and restore tokens between runs and any token
+	// found in it will take precedence over RefreshToken.
+	TokenStore TokenStore
+	// OnRequest is optional, if provided then it is called after every request to GoG with how long it took to get a
+	// response. Endpoints are named without anything specific to a game or file, eg. "gameDetails" or "downloads".
+	OnRequest func(endpoint string, duration time.Duration, err error)
+	// OnLog is optional, if provided then it is given anything the client has to say instead of the standard logger.
+	OnLog       func(message string)
+	accessToken *string
+	tokenExpiry int64
+	tokenLoaded bool
+	lock        sync.Mutex
 }
 
 // MediaType is an enumeration to pick between different supported types of media in GoG.
@@ -40,24 +58,112 @@ const (
 	MovieMediaType
 )
 
-func (client *Client) refreshAccess() error {
+// logf reports a message to OnLog, or the standard logger if there isn't one.
+func (client *Client) logf(format string, args ...interface{}) {
+	if client.OnLog != nil {
+		client.OnLog(fmt.Sprintf(format, args...))
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (client *Client) refreshAccess(ctx context.Context) error {
 	client.lock.Lock()
 	defer client.lock.Unlock()
+	if !client.tokenLoaded && client.TokenStore != nil {
+		client.tokenLoaded = true
+		token, err := client.TokenStore.LoadToken()
+		if err != nil {
+			return &AuthError{err}
+		}
+		if token != nil && token.RefreshToken != "" {
+			client.RefreshToken = token.RefreshToken
+			if token.AccessToken != "" {
+				client.accessToken = &token.AccessToken
+				client.tokenExpiry = token.Expiry
+			}
+		}
+	}
 	if client.tokenExpiry-time.Now().Unix() > 60 {
 		return nil
 	}
-	log.Println("Re-generating the access token for GoG.")
-	response, err := client.Get(AuthEndpoint + "/token?client_id=" + clientID + "&client_secret=" + clientSecret + "&grant_type=refresh_token&refresh_token=" + client.RefreshToken)
+	client.logf("Re-generating the access token for GoG.")
+	err := client.requestToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {client.RefreshToken},
+	})
+	var serverErr *ServerError
+	var rateLimitErr *RateLimitError
+	if ctx.Err() != nil {
+		// Being cancelled says nothing about whether our tokens are any good.
+		return ctx.Err()
+	} else if errors.As(err, &serverErr) || errors.As(err, &rateLimitErr) {
+		// Neither does GoG having problems of its own.
+		return err
+	} else if err != nil {
+		return &AuthError{err}
+	}
+	return nil
+}
+
+// LoginURL is the page that a user needs to visit to log in to GoG and authorise this client.
+//
+// After logging in the user is redirected to a page with a code in the address which can then be passed to Login().
+func (client *Client) LoginURL() string {
+	return client.authEndpoint() + "/auth?" + url.Values{
+		"client_id":     {clientID},
+		"redirect_uri":  {loginRedirectURL},
+		"response_type": {"code"},
+		"layout":        {"client2"},
+	}.Encode()
+}
+
+// Login exchanges a code from the page the user was redirected to after visiting LoginURL() for a new set of tokens.
+func (client *Client) Login(ctx context.Context, code string) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	// Anything in the token store is about to be out of date.
+	client.tokenLoaded = true
+	err := client.requestToken(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {loginRedirectURL},
+	})
+	if err != nil {
+		return &AuthError{err}
+	}
+	return nil
+}
+
+func (client *Client) authEndpoint() string {
+	if client.AuthURL != "" {
+		return client.AuthURL
+	}
+	return AuthEndpoint
+}
+
+// requestToken fetches new tokens from the auth endpoint and saves them. The caller is expected to hold the lock.
+func (client *Client) requestToken(ctx context.Context, params url.Values) error {
+	params.Set("client_id", clientID)
+	params.Set("client_secret", clientSecret)
+	request, err := http.NewRequestWithContext(ctx, "GET", client.authEndpoint()+"/token?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	response, err := client.Do(request)
+	client.observe("token", start, err)
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 
 	buf, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return err
 	}
 	if response.StatusCode/100 != 2 {
-		return fmt.Errorf("Unexpected status code: %d\n%s", response.StatusCode, buf)
+		return fmt.Errorf("%w\n%s", responseError(response), buf)
 	}
 	var login = new(refreshTokenResponse)
 	err = json.Unmarshal(buf, &login)
@@ -67,6 +173,21 @@ func (client *Client) refreshAccess() error {
 
 	client.tokenExpiry = time.Now().Unix() + int64(login.ExpiresIn)
 	client.accessToken = &login.AccessToken
+	if login.RefreshToken != "" {
+		client.RefreshToken = login.RefreshToken
+	}
+
+	if client.TokenStore != nil {
+		err = client.TokenStore.SaveToken(&Token{
+			RefreshToken: client.RefreshToken,
+			AccessToken:  login.AccessToken,
+			Expiry:       client.tokenExpiry,
+		})
+		if err != nil {
+			// We still have a perfectly good access token for this run.
+			client.logf("Unable to save the new tokens from GoG: %+v", err)
+		}
+	}
 	return nil
 }
 
@@ -76,9 +197,9 @@ func (client *Client) refreshAccess() error {
 //
 // See also GetFilteredProducts()
 // See also https://gogapidocs.readthedocs.io/en/latest/account.html#get--user-data-games
-func (client *Client) GameList() ([]int64, error) {
+func (client *Client) GameList(ctx context.Context) ([]int64, error) {
 	var result = new(gameList)
-	err := client.authenticatedGet(EmbedEndpoint+"/user/data/games", result)
+	err := client.authenticatedGet(ctx, EmbedEndpoint+"/user/data/games", result)
 	if err != nil {
 		return nil, err
 	}
@@ -87,9 +208,9 @@ func (client *Client) GameList() ([]int64, error) {
 }
 
 // GetFilteredProducts returns paginated search results for games or movies purchased by the current user.
-func (client *Client) GetFilteredProducts(mediaType MediaType, page int) (*FilteredProductPage, error) {
+func (client *Client) GetFilteredProducts(ctx context.Context, mediaType MediaType, page int) (*FilteredProductPage, error) {
 	var result = new(FilteredProductPage)
-	err := client.authenticatedGet(fmt.Sprintf("%s/account/getFilteredProducts?mediaType=%d&page=%d", EmbedEndpoint, mediaType, page), result)
+	err := client.authenticatedGet(ctx, fmt.Sprintf("%s/account/getFilteredProducts?mediaType=%d&page=%d", EmbedEndpoint, mediaType, page), result)
 	if err != nil {
 		return nil, err
 	}
@@ -98,9 +219,72 @@ func (client *Client) GetFilteredProducts(mediaType MediaType, page int) (*Filte
 }
 
 // GameDetails returns detailed information about a single game.
-func (client *Client) GameDetails(id int64) (*GameDetails, error) {
+func (client *Client) GameDetails(ctx context.Context, id int64) (*GameDetails, error) {
+	var result = new(GameDetails)
+	err := client.authenticatedGet(ctx, fmt.Sprintf("%s/account/gameDetails/%d.json", EmbedEndpoint, id), result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetChecksum fetches the checksum manifest that GoG publishes alongside a download.
+//
+// GoG only publishes these for installers, so this will return nil without an error for files which don't have one
+// such as most extras.
+func (client *Client) GetChecksum(ctx context.Context, URL string) (*FileChecksum, error) {
+	// Only ask for a single byte, we're only interested in where GoG redirects us to.
+	response, err := client.get(ctx, URL, "bytes=0-0")
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	checksumURL := *response.Request.URL
+	checksumURL.Path += ".xml"
+	checksumURL.RawPath = ""
+	request, err := http.NewRequestWithContext(ctx, "GET", checksumURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	response, err = client.Do(request)
+	client.observe("checksum", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%w\n%s", responseError(response), buf)
+	}
+
+	var result = new(FileChecksum)
+	err = xml.Unmarshal(buf, result)
+	if err != nil {
+		return nil, err
+	}
+	if result.MD5 == "" {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// MovieDetails returns detailed information about a single movie.
+//
+// Movies share most of their structure with games, but their downloads aren't broken up by platform. See
+// GameLanguages.Files.
+func (client *Client) MovieDetails(ctx context.Context, id int64) (*GameDetails, error) {
 	var result = new(GameDetails)
-	err := client.authenticatedGet(fmt.Sprintf("%s/account/gameDetails/%d.json", EmbedEndpoint, id), result)
+	err := client.authenticatedGet(ctx, fmt.Sprintf("%s/account/movieDetails/%d.json", EmbedEndpoint, id), result)
 	if err != nil {
 		return nil, err
 	}
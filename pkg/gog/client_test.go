@@ -0,0 +1,156 @@
+package gog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// authServer pretends to be GoG's auth endpoint, handing out tokens for a single valid code and refresh token.
+func authServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/token" {
+			t.Errorf("Unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if query.Get("client_id") != clientID || query.Get("client_secret") != clientSecret {
+			t.Errorf("Missing client credentials: %s", r.URL.RawQuery)
+		}
+
+		switch query.Get("grant_type") {
+		case "authorization_code":
+			if query.Get("redirect_uri") != loginRedirectURL {
+				t.Errorf("Unexpected redirect_uri: %s", query.Get("redirect_uri"))
+			}
+			if query.Get("code") != "valid-code" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"access-1","refresh_token":"refresh-1","expires_in":3600,"user_id":"1"}`)
+		case "refresh_token":
+			if query.Get("refresh_token") != "refresh-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"access-2","refresh_token":"refresh-2","expires_in":3600,"user_id":"1"}`)
+		default:
+			t.Errorf("Unexpected grant_type: %s", query.Get("grant_type"))
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func tempTokenStore(t *testing.T) *FileTokenStore {
+	dir, err := ioutil.TempDir("", "gog-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &FileTokenStore{Path: filepath.Join(dir, "nested", "token.json")}
+}
+
+func TestLoginSavesTokens(t *testing.T) {
+	server := authServer(t)
+	defer server.Close()
+	store := tempTokenStore(t)
+	client := &Client{Client: server.Client(), AuthURL: server.URL, TokenStore: store}
+
+	if err := client.Login(context.Background(), "valid-code"); err != nil {
+		t.Fatalf("Login failed: %+v", err)
+	}
+	if client.RefreshToken != "refresh-1" || client.accessToken == nil || *client.accessToken != "access-1" {
+		t.Errorf("Login didn't keep the new tokens: %q %v", client.RefreshToken, client.accessToken)
+	}
+
+	token, err := store.LoadToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.RefreshToken != "refresh-1" || token.AccessToken != "access-1" || token.Expiry == 0 {
+		t.Fatalf("Login didn't save the new tokens: %+v", token)
+	}
+	info, err := os.Stat(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Token file should only be readable by the current user, got %s", info.Mode().Perm())
+	}
+}
+
+func TestLoginRejectedCode(t *testing.T) {
+	server := authServer(t)
+	defer server.Close()
+	store := tempTokenStore(t)
+	client := &Client{Client: server.Client(), AuthURL: server.URL, TokenStore: store}
+
+	err := client.Login(context.Background(), "wrong-code")
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("Expected an AuthError, got %#v", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the status code to be kept, got %#v", err)
+	}
+	if !IsPermanent(err) {
+		t.Errorf("A rejected login shouldn't be retried")
+	}
+	if token, _ := store.LoadToken(); token != nil {
+		t.Errorf("Nothing should be saved after a failed login, got %+v", token)
+	}
+}
+
+func TestRefreshRotatesStoredToken(t *testing.T) {
+	server := authServer(t)
+	defer server.Close()
+	store := tempTokenStore(t)
+	if err := store.SaveToken(&Token{RefreshToken: "refresh-1"}); err != nil {
+		t.Fatal(err)
+	}
+	// The token store takes precedence over RefreshToken.
+	client := &Client{Client: server.Client(), AuthURL: server.URL, TokenStore: store, RefreshToken: "stale"}
+
+	if err := client.refreshAccess(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %+v", err)
+	}
+	token, err := store.LoadToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.RefreshToken != "refresh-2" || token.AccessToken != "access-2" {
+		t.Errorf("Refresh didn't save the rotated tokens: %+v", token)
+	}
+
+	// A second client picking up the saved tokens shouldn't need to talk to GoG at all.
+	server.Close()
+	again := &Client{Client: server.Client(), AuthURL: server.URL, TokenStore: store}
+	if err := again.refreshAccess(context.Background()); err != nil {
+		t.Fatalf("Saved access token wasn't reused: %+v", err)
+	}
+	if *again.accessToken != "access-2" {
+		t.Errorf("Expected the saved access token, got %s", *again.accessToken)
+	}
+}
+
+func TestRefreshRejected(t *testing.T) {
+	server := authServer(t)
+	defer server.Close()
+	client := &Client{Client: server.Client(), AuthURL: server.URL, RefreshToken: "revoked"}
+
+	err := client.refreshAccess(context.Background())
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("Expected an AuthError, got %#v", err)
+	}
+}
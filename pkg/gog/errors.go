@@ -0,0 +1,141 @@
+package gog
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AuthError is returned when GoG refuses to issue an access token, usually because the refresh token is no longer
+// valid.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "Unable to authenticate with GoG: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// TokenExpiredError is returned when GoG rejects the access token for a request. The token is thrown away so that the
+// next request will fetch a new one.
+type TokenExpiredError struct {
+	StatusCode int
+}
+
+func (e *TokenExpiredError) Error() string {
+	return fmt.Sprintf("GoG.com rejected the access token (status code %d)", e.StatusCode)
+}
+
+// NotFoundError is returned when GoG doesn't have what was asked for. Asking again won't help.
+type NotFoundError struct {
+	StatusCode int
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("Not found on GoG.com (status code %d)", e.StatusCode)
+}
+
+// RateLimitError is returned when GoG wants us to slow down.
+type RateLimitError struct {
+	StatusCode int
+	// RetryAfter is how long GoG asked us to wait before trying again, or zero if it didn't say.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("Rate limited by GoG.com, retry after %s (status code %d)", e.RetryAfter, e.StatusCode)
+	}
+	return fmt.Sprintf("Rate limited by GoG.com (status code %d)", e.StatusCode)
+}
+
+// ServerError is returned when GoG has problems of its own, which are usually temporary.
+type ServerError struct {
+	StatusCode int
+	// RetryAfter is how long GoG asked us to wait before trying again, or zero if it didn't say.
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("GoG.com had an internal error (status code %d)", e.StatusCode)
+}
+
+// StatusError is returned for any other unexpected status code from GoG.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Unexpected status code: %d", e.StatusCode)
+}
+
+// IsPermanent checks whether an error from GoG will happen again no matter how many times a request is retried, such as
+// a file which doesn't exist or a refresh token which is no longer valid.
+func IsPermanent(err error) bool {
+	var authErr *AuthError
+	var notFoundErr *NotFoundError
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &authErr), errors.As(err, &notFoundErr):
+		return true
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		// GoG's CDN refuses download links once they've expired, and the next attempt will fetch a new one. A range
+		// which can't be satisfied means that the file changed underneath an interrupted download, which is fixed by
+		// starting again.
+		case http.StatusRequestTimeout, http.StatusForbidden, http.StatusRequestedRangeNotSatisfiable:
+			return false
+		}
+		return statusErr.StatusCode/100 == 4
+	}
+	return false
+}
+
+// RetryAfter is how long GoG asked us to wait before retrying a request that caused an error, or zero if it didn't say.
+func RetryAfter(err error) time.Duration {
+	var rateLimitErr *RateLimitError
+	var serverErr *ServerError
+	if errors.As(err, &rateLimitErr) {
+		return rateLimitErr.RetryAfter
+	} else if errors.As(err, &serverErr) {
+		return serverErr.RetryAfter
+	}
+	return 0
+}
+
+// responseError creates an error for a response with an unsuccessful status code.
+func responseError(response *http.Response) error {
+	switch code := response.StatusCode; {
+	case code == http.StatusUnauthorized:
+		return &TokenExpiredError{code}
+	case code == http.StatusNotFound || code == http.StatusGone:
+		return &NotFoundError{code}
+	case code == http.StatusTooManyRequests:
+		return &RateLimitError{code, parseRetryAfter(response.Header.Get("Retry-After"))}
+	case code/100 == 5:
+		return &ServerError{code, parseRetryAfter(response.Header.Get("Retry-After"))}
+	default:
+		return &StatusError{code}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or a date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && time.Until(date) > 0 {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,30 @@
+package gog
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestIsPermanent(t *testing.T) {
+	for code, expected := range map[int]bool{
+		http.StatusBadRequest:                   true,
+		http.StatusUnauthorized:                 false,
+		http.StatusForbidden:                    false,
+		http.StatusNotFound:                     true,
+		http.StatusRequestTimeout:               false,
+		http.StatusGone:                         true,
+		http.StatusRequestedRangeNotSatisfiable: false,
+		http.StatusTooManyRequests:              false,
+		http.StatusInternalServerError:          false,
+		http.StatusServiceUnavailable:           false,
+	} {
+		err := fmt.Errorf("Unable to download: %w", responseError(&http.Response{StatusCode: code}))
+		if IsPermanent(err) != expected {
+			t.Errorf("%d: expected permanent to be %v", code, expected)
+		}
+	}
+	if !IsPermanent(&AuthError{fmt.Errorf("invalid_grant")}) {
+		t.Errorf("Expected an AuthError to be permanent")
+	}
+}
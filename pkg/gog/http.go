@@ -1,20 +1,24 @@
 package gog
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func (client *Client) authenticatedGet(URL string, result interface{}) error {
-	_, body, _, err := client.DownloadFile(URL)
+func (client *Client) authenticatedGet(ctx context.Context, URL string, result interface{}) error {
+	_, body, _, err := client.DownloadFile(ctx, URL)
 	if err != nil {
 		return err
 	}
+	defer body.Close()
 	buf, err := ioutil.ReadAll(body)
 	if err != nil {
 		return err
@@ -28,22 +32,28 @@ func (client *Client) authenticatedGet(URL string, result interface{}) error {
 }
 
 // DownloadFile initiates a download of a file from GoG and returns a filename and ReadCloser
-// to control the download.
-func (client *Client) DownloadFile(URL string) (string, io.ReadCloser, *int64, error) {
-	if err := client.refreshAccess(); err != nil {
-		return "", nil, nil, err
+// to control the download. Cancelling ctx aborts the download.
+func (client *Client) DownloadFile(ctx context.Context, URL string) (string, io.ReadCloser, *int64, error) {
+	filename, body, length, _, err := client.DownloadFileRange(ctx, URL, 0)
+	return filename, body, length, err
+}
+
+// DownloadFileRange initiates a download of a file from GoG starting at the given byte offset.
+//
+// The returned offset is where the returned ReadCloser actually starts, which will be zero if the server decided to
+// ignore the range request and send the whole file instead. The returned length is the number of bytes remaining from
+// that offset.
+func (client *Client) DownloadFileRange(ctx context.Context, URL string, offset int64) (string, io.ReadCloser, *int64, int64, error) {
+	var byteRange string
+	if offset > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-", offset)
 	}
-	request, err := http.NewRequest("GET", URL, nil)
+	response, err := client.get(ctx, URL, byteRange)
 	if err != nil {
-		return "", nil, nil, err
+		return "", nil, nil, 0, err
 	}
-	request.Header.Add("Authorization", "Bearer "+*client.accessToken)
-	response, err := client.Do(request)
-	if err != nil {
-		return "", nil, nil, err
-	}
-	if response.StatusCode/100 != 2 {
-		return "", nil, nil, fmt.Errorf("Unexpected status code: %d", response.StatusCode)
+	if response.StatusCode != http.StatusPartialContent {
+		offset = 0
 	}
 
 	segments := strings.Split(response.Request.URL.Path, "/")
@@ -51,10 +61,93 @@ func (client *Client) DownloadFile(URL string) (string, io.ReadCloser, *int64, e
 	if len(response.Header["Content-Length"]) > 0 {
 		len, err := strconv.ParseInt(response.Header["Content-Length"][0], 10, 64)
 		if err != nil {
-			return "", nil, nil, err
+			response.Body.Close()
+			return "", nil, nil, 0, err
 		}
 		length = &len
 	}
 
-	return segments[len(segments)-1], response.Body, length, nil
+	return segments[len(segments)-1], response.Body, length, offset, nil
+}
+
+// StatFile looks up the filename and size of a download from GoG without downloading it.
+func (client *Client) StatFile(ctx context.Context, URL string) (string, *int64, error) {
+	response, err := client.get(ctx, URL, "bytes=0-0")
+	if err != nil {
+		return "", nil, err
+	}
+	response.Body.Close()
+
+	segments := strings.Split(response.Request.URL.Path, "/")
+	var size *int64
+	if response.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-0/<size>
+		contentRange := response.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 && contentRange[i+1:] != "*" {
+			len, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+			if err != nil {
+				return "", nil, err
+			}
+			size = &len
+		}
+	} else if response.ContentLength >= 0 {
+		size = &response.ContentLength
+	}
+
+	return segments[len(segments)-1], size, nil
+}
+
+// get makes an authenticated request to GoG, optionally for only a range of bytes.
+func (client *Client) get(ctx context.Context, URL string, byteRange string) (*http.Response, error) {
+	if err := client.refreshAccess(ctx); err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Authorization", "Bearer "+*client.accessToken)
+	if byteRange != "" {
+		request.Header.Add("Range", byteRange)
+	}
+	start := time.Now()
+	response, err := client.Do(request)
+	if err == nil && response.StatusCode/100 != 2 {
+		response.Body.Close()
+		err = responseError(response)
+		if _, expired := err.(*TokenExpiredError); expired {
+			client.lock.Lock()
+			client.tokenExpiry = 0
+			client.lock.Unlock()
+		}
+	}
+	client.observe(endpoint(URL), start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// observe reports a request to OnRequest.
+func (client *Client) observe(endpoint string, start time.Time, err error) {
+	if client.OnRequest != nil {
+		client.OnRequest(endpoint, time.Since(start), err)
+	}
+}
+
+// endpoint names the part of the API that a URL belongs to, eg. "/account/gameDetails/1207658924.json" is
+// "gameDetails".
+func endpoint(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "unknown"
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) > 1 && segments[0] == "account" {
+		return segments[1]
+	} else if segments[0] == "downloads" {
+		return "downloads"
+	}
+	return strings.Join(segments, "/")
 }
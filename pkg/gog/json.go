@@ -1,14 +1,16 @@
 package gog
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 )
 
 type refreshTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	UserID      string `json:"user_id"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	UserID       string `json:"user_id"`
 }
 
 type gameList struct {
@@ -29,12 +31,15 @@ type GameDetails struct {
 type GameLanguages struct {
 	Language  string
 	Platforms *GamePlatforms
+	// Files is used instead of Platforms for media which doesn't depend on a platform, such as movies.
+	Files []*GameDownload
 }
 
 // UnmarshalJSON is used by the JSON marshaller to generate GameLanguages structs from JSON tuples.
 //
 // The structure that GoG uses for these fields is a tuple where the first element is a string that describes
-// the language. The second object in the tuple is an object describing the platforms supported by that language.
+// the language. The second object in the tuple is an object describing the platforms supported by that language, or
+// for movies a plain list of downloads.
 func (gl *GameLanguages) UnmarshalJSON(b []byte) error {
 	var languages []json.RawMessage
 	err := json.Unmarshal(b, &languages)
@@ -48,7 +53,11 @@ func (gl *GameLanguages) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(languages[1], &gl.Platforms)
+	if trimmed := bytes.TrimSpace(languages[1]); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(languages[1], &gl.Files)
+	} else {
+		err = json.Unmarshal(languages[1], &gl.Platforms)
+	}
 	if err != nil {
 		return err
 	}
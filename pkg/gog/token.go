@@ -0,0 +1,76 @@
+package gog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Token is the set of credentials used to access the GoG API.
+type Token struct {
+	RefreshToken string `json:"refresh_token"`
+	AccessToken  string `json:"access_token"`
+	// Expiry is the unix timestamp at which AccessToken stops being valid.
+	Expiry int64 `json:"expiry"`
+}
+
+// TokenStore is used by Client to keep hold of the latest tokens between runs.
+//
+// GoG rotates the refresh token every time it is used so without somewhere to save the new one the original refresh
+// token will eventually stop working.
+type TokenStore interface {
+	// LoadToken returns the last saved token, or nil if nothing has been saved yet.
+	LoadToken() (*Token, error)
+	SaveToken(token *Token) error
+}
+
+// FileTokenStore is a TokenStore which saves tokens to a JSON file that only the current user may read.
+type FileTokenStore struct {
+	Path string
+}
+
+// LoadToken implements TokenStore.
+func (store *FileTokenStore) LoadToken() (*Token, error) {
+	buf, err := ioutil.ReadFile(store.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var token = new(Token)
+	err = json.Unmarshal(buf, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// SaveToken implements TokenStore.
+func (store *FileTokenStore) SaveToken(token *Token) error {
+	buf, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(store.Path), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash can't leave us without a valid refresh token.
+	tmpfile := store.Path + ".tmp"
+	err = ioutil.WriteFile(tmpfile, buf, 0600)
+	if err != nil {
+		return err
+	}
+	// WriteFile doesn't change the permissions of a file which already existed.
+	err = os.Chmod(tmpfile, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile, store.Path)
+}
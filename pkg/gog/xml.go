@@ -0,0 +1,24 @@
+package gog
+
+// FileChecksum is the checksum manifest that GoG publishes for an installer.
+//
+// Larger files are also broken up into chunks which are checksummed individually, this is what Galaxy uses to resume
+// and repair downloads.
+type FileChecksum struct {
+	Name      string           `xml:"name,attr"`
+	Available int              `xml:"available,attr"`
+	MD5       string           `xml:"md5,attr"`
+	Timestamp string           `xml:"timestamp,attr"`
+	TotalSize int64            `xml:"total_size,attr"`
+	Chunks    []*ChecksumChunk `xml:"chunk"`
+}
+
+// ChecksumChunk is the checksum for a single range of bytes inside of a larger file.
+type ChecksumChunk struct {
+	ID     int    `xml:"id,attr"`
+	From   int64  `xml:"from,attr"`
+	To     int64  `xml:"to,attr"`
+	Method string `xml:"method,attr"`
+	// The checksum itself, calculated using Method.
+	Checksum string `xml:",chardata"`
+}